@@ -8,21 +8,28 @@
 package main
 
 import (
+	"bytes"
 	"crypto/rand"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"net"
 	"os"
 	"os/user"
 	"path/filepath"
 	rtdebug "runtime/debug"
+	"strings"
 	"testing"
+	"time"
 
 	go9p "github.com/lionkov/go9p/p"
 	"github.com/lionkov/go9p/p/clnt"
 	"upspin.io/bind"
+	"upspin.io/client"
 	"upspin.io/config"
 	"upspin.io/errors"
 	"upspin.io/factotum"
+	"upspin.io/pack"
 	"upspin.io/test/testutil"
 	"upspin.io/upspin"
 
@@ -122,7 +129,7 @@ func mount() error {
 	testConfig.cfg = cfg
 
 	// start server
-	go do(cfg, "tcp", serverAddr, *debug)
+	go do(cfg, "tcp", serverAddr, &options{debug: *debug})
 
 	// The server may take some time to start up
 	var client *clnt.Clnt
@@ -283,6 +290,848 @@ func TestFile(t *testing.T) {
 	remove(t, testDir)
 }
 
+// TestLargeFile tests writing and reading a file spanning several blocks,
+// which is kept in a temporary file while written.
+func TestLargeFile(t *testing.T) {
+	testDir := mkTestDir(t, "testlarge")
+	buf := randomBytes(t, 2*upspin.BlockSize+100)
+
+	fn := filepath.Join(testDir, "file")
+	mkFile(t, fn, buf)
+	readAndCheckContentsOrDie(t, fn, buf)
+
+	// Rewrite part of the second block.
+	for i := upspin.BlockSize; i < upspin.BlockSize+1000; i++ {
+		buf[i] = buf[i] ^ 0xff
+	}
+	f, err := testConfig.clnt.FOpen(fn, go9p.OWRITE)
+	if err != nil {
+		fatal(t, err)
+	}
+	if _, err := f.Writen(buf[upspin.BlockSize:upspin.BlockSize+1000], upspin.BlockSize); err != nil {
+		f.Close()
+		fatal(t, err)
+	}
+	if err := f.Close(); err != nil {
+		fatal(t, err)
+	}
+	readAndCheckContentsOrDie(t, fn, buf)
+	remove(t, fn)
+	remove(t, testDir)
+}
+
+// TestWriteLink tests that a large file written through a link
+// is stored in the file the link refers to.
+func TestWriteLink(t *testing.T) {
+	testDir := mkTestDir(t, "testwritelink")
+	buf := randomBytes(t, 2*upspin.BlockSize+100)
+	fn := filepath.Join(testDir, "file")
+	mkFile(t, fn, []byte("old"))
+	link := filepath.Join(testDir, "link")
+	if _, err := client.New(testConfig.cfg).PutLink(upspin.PathName(fn), upspin.PathName(link)); err != nil {
+		fatal(t, err)
+	}
+
+	f, err := testConfig.clnt.FOpen(link, go9p.OWRITE|go9p.OTRUNC)
+	if err != nil {
+		fatal(t, err)
+	}
+	if _, err := f.Writen(buf, 0); err != nil {
+		f.Close()
+		fatal(t, err)
+	}
+	if err := f.Close(); err != nil {
+		fatal(t, err)
+	}
+	readAndCheckContentsOrDie(t, fn, buf)
+	entry, err := client.New(testConfig.cfg).Lookup(upspin.PathName(link), false)
+	if err != nil {
+		fatal(t, err)
+	}
+	if !entry.IsLink() {
+		fatalf(t, "%s is no longer a link", link)
+	}
+	remove(t, link)
+	remove(t, fn)
+	remove(t, testDir)
+}
+
+// TestReadWrite tests reading a file opened for both reading and
+// writing, before and after modifying it.
+func TestReadWrite(t *testing.T) {
+	testDir := mkTestDir(t, "testrdwr")
+	buf := randomBytes(t, 1000)
+
+	fn := filepath.Join(testDir, "file")
+	mkFile(t, fn, buf)
+	f, err := testConfig.clnt.FOpen(fn, go9p.ORDWR)
+	if err != nil {
+		fatal(t, err)
+	}
+	rbuf := make([]byte, 100)
+	if _, err := f.ReadAt(rbuf, 500); err != nil {
+		f.Close()
+		fatal(t, err)
+	}
+	if !bytes.Equal(rbuf, buf[500:600]) {
+		f.Close()
+		fatal(t, "read wrong contents")
+	}
+	for i := range rbuf {
+		rbuf[i] ^= 0xff
+	}
+	if _, err := f.WriteAt(rbuf, 500); err != nil {
+		f.Close()
+		fatal(t, err)
+	}
+	copy(buf[500:], rbuf)
+	rbuf = make([]byte, len(buf))
+	if _, err := f.ReadAt(rbuf, 0); err != nil {
+		f.Close()
+		fatal(t, err)
+	}
+	if !bytes.Equal(rbuf, buf) {
+		f.Close()
+		fatal(t, "read wrong contents after write")
+	}
+	if err := f.Close(); err != nil {
+		fatal(t, err)
+	}
+	readAndCheckContentsOrDie(t, fn, buf)
+	remove(t, fn)
+	remove(t, testDir)
+}
+
+func writeCtl(cmd string) error {
+	f, err := testConfig.clnt.FOpen("ctl", go9p.OWRITE)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.Write([]byte(cmd))
+	return err
+}
+
+func TestCtl(t *testing.T) {
+	testDir := mkTestDir(t, "testctl")
+	buf := randomBytes(t, 100)
+	fn := filepath.Join(testDir, "file")
+	wf := writeFile(t, fn, buf)
+
+	f, err := testConfig.clnt.FOpen("status", go9p.OREAD)
+	if err != nil {
+		fatal(t, err)
+	}
+	status, err := ioutil.ReadAll(f)
+	f.Close()
+	if err != nil {
+		fatal(t, err)
+	}
+	if want := fmt.Sprintf("pending %s %d\n", fn, len(buf)); !strings.Contains(string(status), want) {
+		fatalf(t, "status %q does not contain %q", status, want)
+	}
+
+	// The contents are visible before close once synced.
+	if err := writeCtl("sync " + fn + "\n"); err != nil {
+		fatal(t, err)
+	}
+	readAndCheckContentsOrDie(t, fn, buf)
+	if err := wf.Close(); err != nil {
+		fatal(t, err)
+	}
+
+	for _, cmd := range []string{"sync " + fn, "bogus", "debug x"} {
+		if err := writeCtl(cmd); err == nil {
+			fatalf(t, "ctl %q succeeded", cmd)
+		}
+	}
+	if err := writeCtl("debug 0\nflush\n"); err != nil {
+		fatal(t, err)
+	}
+	remove(t, fn)
+	remove(t, testDir)
+}
+
+func TestClunkError(t *testing.T) {
+	testDir := mkTestDir(t, "testclunkerror")
+	acc := filepath.Join(testDir, "Access")
+
+	// The last line, being incomplete, is checked only when the
+	// file is stored on clunk, which must then fail, leaving the
+	// empty file made by create.
+	f := writeFile(t, acc, []byte("read: bob@example.com\nbogus"))
+	if err := f.Close(); err == nil {
+		fatalf(t, "clunk of malformed %s succeeded", acc)
+	}
+	readAndCheckContentsOrDie(t, acc, []byte{})
+
+	f, err := testConfig.clnt.FOpen("errors", go9p.OREAD)
+	if err != nil {
+		fatal(t, err)
+	}
+	log, err := ioutil.ReadAll(f)
+	f.Close()
+	if err != nil {
+		fatal(t, err)
+	}
+	if want := " " + acc + ": "; !strings.Contains(string(log), want) {
+		fatalf(t, "errors %q does not contain %q", log, want)
+	}
+	remove(t, acc)
+	remove(t, testDir)
+}
+
+// TestClunkFid tests that a fid is released by a Tclunk that fails,
+// so that its number can be used again.
+func TestClunkFid(t *testing.T) {
+	testDir := mkTestDir(t, "testclunkfid")
+	conn, err := net.Dial("tcp", serverAddr)
+	if err != nil {
+		fatal(t, err)
+	}
+	defer conn.Close()
+	c := &dotlClient{conn: conn}
+	var req lenc
+	req.u32(8192)
+	req.str("9P2000")
+	c.rpc(t, go9p.Tversion, req)
+	req = nil
+	req.u32(0)
+	req.u32(go9p.NOFID)
+	req.str("")
+	req.str("")
+	c.rpc(t, go9p.Tattach, req)
+
+	// The incomplete last line of the Access file makes storing it fail.
+	c.walk(t, 0, 1, testDir)
+	req = nil
+	req.u32(1)
+	req.str("Access")
+	req.u32(0600)
+	req.u8(go9p.OWRITE)
+	c.rpc(t, go9p.Tcreate, req)
+	data := "read: bob@example.com\nbogus"
+	req = nil
+	req.u32(1)
+	req.u64(0)
+	req.u32(uint32(len(data)))
+	req = append(req, data...)
+	c.rpc(t, go9p.Twrite, req)
+	req = nil
+	req.u32(1)
+	if _, errno := c.call(t, go9p.Tclunk, req); errno == 0 {
+		fatalf(t, "clunk of malformed Access file succeeded")
+	}
+
+	c.walk(t, 0, 1, testDir)
+	req = nil
+	req.u32(1)
+	c.rpc(t, go9p.Tclunk, req)
+	remove(t, filepath.Join(testDir, "Access"))
+	remove(t, testDir)
+}
+
+func TestConflict(t *testing.T) {
+	testDir := mkTestDir(t, "testconflict")
+	fn := filepath.Join(testDir, "file")
+	mkFile(t, fn, []byte("hello"))
+
+	// A change made after the file is opened is not overwritten.
+	f := writeFile(t, fn, []byte("HELLO"))
+	c := client.New(testConfig.cfg)
+	if _, err := c.Put(upspin.PathName(fn), []byte("theirs")); err != nil {
+		fatal(t, err)
+	}
+	// Each store, as by a null wstat, fails, but only the first
+	// makes a conflicting copy, which the later ones update.
+	for i := 0; i < 2; i++ {
+		if err := wstat(fn, go9p.NewWstatDir()); err == nil {
+			fatalf(t, "wstat %d of %s overwrote a newer version", i, fn)
+		}
+	}
+	if _, err := f.Writen([]byte("!"), 5); err != nil {
+		fatal(t, err)
+	}
+	if err := f.Close(); err == nil {
+		fatalf(t, "clunk of %s overwrote a newer version", fn)
+	}
+	readAndCheckContentsOrDie(t, fn, []byte("theirs"))
+
+	conflicts, err := c.Glob(fn + ".conflict-*")
+	if err != nil {
+		fatal(t, err)
+	}
+	if len(conflicts) != 1 {
+		fatalf(t, "found %d conflicting copies of %s, want 1", len(conflicts), fn)
+	}
+	prefix := fmt.Sprintf("%s.conflict-%s-", fn, testConfig.cfg.UserName())
+	if name := string(conflicts[0].Name); !strings.HasPrefix(name, prefix) {
+		fatalf(t, "conflicting copy is %s, want prefix %s", name, prefix)
+	}
+	readAndCheckContentsOrDie(t, string(conflicts[0].Name), []byte("HELLO!"))
+
+	remove(t, string(conflicts[0].Name))
+	remove(t, fn)
+	remove(t, testDir)
+}
+
+// TestFsync tests that a null wstat and Tfsync store the file being
+// written while it stays open.
+func TestFsync(t *testing.T) {
+	testDir := mkTestDir(t, "testfsync")
+	fn := filepath.Join(testDir, "file")
+	buf := randomBytes(t, 100)
+	wf := writeFile(t, fn, buf[:50])
+	if err := wstat(fn, go9p.NewWstatDir()); err != nil {
+		fatal(t, err)
+	}
+	readAndCheckContentsOrDie(t, fn, buf[:50])
+
+	if _, err := wf.Writen(buf[50:], 50); err != nil {
+		fatal(t, err)
+	}
+	c := dialDotL(t)
+	defer c.conn.Close()
+	c.walk(t, 0, 1, fn)
+	var req lenc
+	req.u32(1)
+	req.u32(0) // datasync
+	c.rpc(t, Tfsync, req)
+	readAndCheckContentsOrDie(t, fn, buf)
+
+	if err := wf.Close(); err != nil {
+		fatal(t, err)
+	}
+	readAndCheckContentsOrDie(t, fn, buf)
+	remove(t, fn)
+	remove(t, testDir)
+}
+
+// TestJournal tests that a file being written when the server dies
+// is stored by the next server using the same cache directory.
+func TestJournal(t *testing.T) {
+	testDir := mkTestDir(t, "testjournal")
+	fn := filepath.Join(testDir, "file")
+	buf := randomBytes(t, 100)
+	cacheDir, err := ioutil.TempDir("", "9upspinfs-journal")
+	if err != nil {
+		fatal(t, err)
+	}
+	defer os.RemoveAll(cacheDir)
+
+	fs := newUpspinFS(testConfig.cfg, &options{cacheDir: cacheDir})
+	file, err := fs.owner.fileCache.Writable(fs.owner.client, upspin.PathName(fn), true)
+	if err != nil {
+		fatal(t, err)
+	}
+	defer file.discard()
+	if _, err := file.WriteAt(buf, 0); err != nil {
+		fatal(t, err)
+	}
+	notExist(t, fn, "write")
+
+	// A file to be removed once closed is not recovered.
+	rfn := filepath.Join(testDir, "orclose")
+	rfile, err := fs.owner.fileCache.Writable(fs.owner.client, upspin.PathName(rfn), true)
+	if err != nil {
+		fatal(t, err)
+	}
+	defer rfile.discard()
+	if _, err := rfile.WriteAt(buf, 0); err != nil {
+		fatal(t, err)
+	}
+	if err := rfile.removeOnClose(); err != nil {
+		fatal(t, err)
+	}
+
+	// A read-only server leaves the journal for a later run.
+	newUpspinFS(testConfig.cfg, &options{cacheDir: cacheDir, readOnly: true}).recoverJournals()
+	notExist(t, fn, "read-only recovery")
+	if names, _ := filepath.Glob(filepath.Join(spillDir(cacheDir), "*")); len(names) != 4 {
+		fatalf(t, "read-only recovery left %v", names)
+	}
+
+	newUpspinFS(testConfig.cfg, &options{cacheDir: cacheDir}).recoverJournals()
+	readAndCheckContentsOrDie(t, fn, buf)
+	notExist(t, rfn, "recovery")
+	if names, _ := filepath.Glob(filepath.Join(spillDir(cacheDir), "*")); len(names) != 0 {
+		fatalf(t, "journal left %v", names)
+	}
+
+	// A file that cannot be stored when closed stays journaled,
+	// also when its recovery fails, until it is stored.
+	gone := mkTestDir(t, "testjournal/gone")
+	gfn := filepath.Join(gone, "file")
+	gfile, err := fs.owner.fileCache.Writable(fs.owner.client, upspin.PathName(gfn), true)
+	if err != nil {
+		fatal(t, err)
+	}
+	defer gfile.discard()
+	if _, err := gfile.WriteAt(buf, 0); err != nil {
+		fatal(t, err)
+	}
+	remove(t, gone)
+	if err := fs.owner.fileCache.Close(gfile); err == nil {
+		fatalf(t, "close of %s in a removed directory succeeded", gfn)
+	}
+	newUpspinFS(testConfig.cfg, &options{cacheDir: cacheDir}).recoverJournals()
+	if names, _ := filepath.Glob(filepath.Join(spillDir(cacheDir), "*")); len(names) != 2 {
+		fatalf(t, "failed recovery left %v", names)
+	}
+	mkTestDir(t, "testjournal/gone")
+	newUpspinFS(testConfig.cfg, &options{cacheDir: cacheDir}).recoverJournals()
+	readAndCheckContentsOrDie(t, gfn, buf)
+	if names, _ := filepath.Glob(filepath.Join(spillDir(cacheDir), "*")); len(names) != 0 {
+		fatalf(t, "journal left %v", names)
+	}
+	remove(t, gfn)
+	remove(t, gone)
+	remove(t, fn)
+	remove(t, testDir)
+}
+
+// TestBlockCache tests that the block cache keeps the most recently
+// used blocks within its size, across restarts.
+func TestBlockCache(t *testing.T) {
+	cacheDir, err := ioutil.TempDir("", "9upspinfs-blocks")
+	if err != nil {
+		fatal(t, err)
+	}
+	defer os.RemoveAll(cacheDir)
+
+	c := newBlockCache(cacheDir, 10)
+	c.put("a", []byte("aaaaaa"))
+	c.put("b", []byte("bbbbbb"))
+	if _, ok := c.get("a"); ok {
+		fatalf(t, "block a not dropped")
+	}
+	c.put("toolarge", make([]byte, 11))
+	if n, size := c.stats(); n != 1 || size != 6 {
+		fatalf(t, "cache holds %d blocks of %d bytes, want 1 of 6", n, size)
+	}
+
+	c = newBlockCache(cacheDir, 10)
+	if data, ok := c.get("b"); !ok || string(data) != "bbbbbb" {
+		fatalf(t, "block b after restart is %q, %v", data, ok)
+	}
+	if c := newBlockCache("", 10); c != nil {
+		fatalf(t, "cache without a directory")
+	}
+
+	// A block whose file is lost is forgotten.
+	if err := os.Remove(filepath.Join(c.dir, "b")); err != nil {
+		fatal(t, err)
+	}
+	if _, ok := c.get("b"); ok {
+		fatalf(t, "lost block b found")
+	}
+	if n, size := c.stats(); n != 0 || size != 0 {
+		fatalf(t, "cache holds %d blocks of %d bytes, want none", n, size)
+	}
+
+	// A block read again is served from the cache, which is shown
+	// by changing the cached copy.
+	testDir := mkTestDir(t, "testblockcache")
+	fn := upspin.PathName(filepath.Join(testDir, "file"))
+	buf := randomBytes(t, 100)
+	cl := client.New(testConfig.cfg)
+	if _, err := cl.Put(fn, buf); err != nil {
+		fatal(t, err)
+	}
+	entry, err := cl.Lookup(fn, true)
+	if err != nil {
+		fatal(t, err)
+	}
+	c = newBlockCache(cacheDir, 1000)
+	read := func() []byte {
+		r, err := Readable(testConfig.cfg, entry, c)
+		if err != nil {
+			fatal(t, err)
+		}
+		defer r.Close()
+		data := make([]byte, len(buf))
+		if _, err := r.ReadAt(data, 0); err != nil && err != io.EOF {
+			fatal(t, err)
+		}
+		return data
+	}
+	if data := read(); !bytes.Equal(data, buf) {
+		fatalf(t, "first read returned wrong contents")
+	}
+	changed := append([]byte(nil), buf...)
+	changed[0] ^= 0xff
+	if err := ioutil.WriteFile(filepath.Join(c.dir, blockKey(entry.Blocks[0].Location)), changed, 0600); err != nil {
+		fatal(t, err)
+	}
+	if data := read(); !bytes.Equal(data, changed) {
+		fatalf(t, "second read not served from the cache")
+	}
+	remove(t, string(fn))
+	remove(t, testDir)
+}
+
+func TestShare(t *testing.T) {
+	testDir := mkTestDir(t, "testshare")
+	fn := filepath.Join(testDir, "file")
+	mkFile(t, fn, randomBytes(t, 100))
+
+	// The reader has a key, for which the key of the file is wrapped.
+	reader := upspin.UserName("reader@example.com")
+	rf, err := factotum.NewFromDir(testutil.Repo("key", "testdata", "user2"))
+	if err != nil {
+		fatal(t, err)
+	}
+	key, err := bind.KeyServer(testConfig.cfg, testConfig.cfg.KeyEndpoint())
+	if err != nil {
+		fatal(t, err)
+	}
+	err = key.Put(&upspin.User{
+		Name:      reader,
+		Dirs:      []upspin.Endpoint{testConfig.cfg.DirEndpoint()},
+		Stores:    []upspin.Endpoint{testConfig.cfg.StoreEndpoint()},
+		PublicKey: rf.PublicKey(),
+	})
+	if err != nil {
+		fatal(t, err)
+	}
+
+	// Sharing twice adds the line once.
+	acc := filepath.Join(testDir, "Access")
+	want := fmt.Sprintf("*: %s\nr,l: %s\n", testConfig.cfg.UserName(), reader)
+	for i := 0; i < 2; i++ {
+		if err := writeCtl(fmt.Sprintf("share add r,l %s %s\n", reader, testDir)); err != nil {
+			fatal(t, err)
+		}
+		readAndCheckContentsOrDie(t, acc, []byte(want))
+	}
+	wrapped := func(u upspin.UserName, key upspin.PublicKey) {
+		entry, err := client.New(testConfig.cfg).Lookup(upspin.PathName(fn), false)
+		if err != nil {
+			fatal(t, err)
+		}
+		hashes, err := pack.Lookup(entry.Packing).ReaderHashes(entry.Packdata)
+		if err != nil {
+			fatal(t, err)
+		}
+		for _, h := range hashes {
+			if bytes.Equal(h, factotum.KeyHash(key)) {
+				return
+			}
+		}
+		fatalf(t, "key of %s not wrapped for %s", fn, u)
+	}
+	wrapped(reader, rf.PublicKey())
+
+	// Sharing a subdirectory, here through a link, that the Access
+	// file governs rewraps the keys of every file it governs.
+	reader2 := upspin.UserName("reader2@example.com")
+	rf2, err := factotum.NewFromDir(testutil.Repo("key", "testdata", "user3"))
+	if err != nil {
+		fatal(t, err)
+	}
+	err = key.Put(&upspin.User{
+		Name:      reader2,
+		Dirs:      []upspin.Endpoint{testConfig.cfg.DirEndpoint()},
+		Stores:    []upspin.Endpoint{testConfig.cfg.StoreEndpoint()},
+		PublicKey: rf2.PublicKey(),
+	})
+	if err != nil {
+		fatal(t, err)
+	}
+	sub := mkTestDir(t, "testshare/sub")
+	link := filepath.Join(testDir, "link")
+	if _, err := client.New(testConfig.cfg).PutLink(upspin.PathName(sub), upspin.PathName(link)); err != nil {
+		fatal(t, err)
+	}
+	if err := writeCtl(fmt.Sprintf("share add r %s %s\n", reader2, link)); err != nil {
+		fatal(t, err)
+	}
+	readAndCheckContentsOrDie(t, acc, []byte(want+fmt.Sprintf("r: %s\n", reader2)))
+	wrapped(reader2, rf2.PublicKey())
+	remove(t, link)
+	remove(t, sub)
+
+	for _, cmd := range []string{"share fix " + fn, "share fix " + testDir} {
+		if err := writeCtl(cmd); err != nil {
+			fatalf(t, "ctl %q: %v", cmd, err)
+		}
+	}
+	for _, cmd := range []string{"share", "share add r " + testDir, "share add bogus bob@example.com " + testDir} {
+		if err := writeCtl(cmd); err == nil {
+			fatalf(t, "ctl %q succeeded", cmd)
+		}
+	}
+
+	remove(t, acc)
+	remove(t, fn)
+	remove(t, testDir)
+}
+
+// TestDirCache tests that changes made behind the server's back
+// are noticed, through Watch or once cached entries expire.
+func TestDirCache(t *testing.T) {
+	testDir := mkTestDir(t, "testdircache")
+	fn := filepath.Join(testDir, "file")
+	mkFile(t, fn, []byte("hello"))
+	if _, err := testConfig.clnt.FStat(fn); err != nil {
+		fatal(t, err)
+	}
+
+	c := client.New(testConfig.cfg)
+	if _, err := c.Put(upspin.PathName(fn), []byte("hello, world")); err != nil {
+		fatal(t, err)
+	}
+	deadline := time.Now().Add(dirCacheTTL + 5*time.Second)
+	for {
+		d, err := testConfig.clnt.FStat(fn)
+		if err != nil {
+			fatal(t, err)
+		}
+		if d.Length == uint64(len("hello, world")) {
+			break
+		}
+		if time.Now().After(deadline) {
+			fatalf(t, "%s: stale length %d", fn, d.Length)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	remove(t, fn)
+	remove(t, testDir)
+}
+
+// TestDirCacheWatch tests that, while the tree is watched, changes
+// made behind the server's back are seen sooner than dirCacheTTL,
+// also when the entries are reached through a link.
+func TestDirCacheWatch(t *testing.T) {
+	testDir := mkTestDir(t, "testdirwatch")
+	fn := upspin.PathName(filepath.Join(testDir, "file"))
+	link := upspin.PathName(filepath.Join(testConfig.root, "testdirwatchlink"))
+	other := client.New(testConfig.cfg)
+	if _, err := other.Put(fn, []byte("hello")); err != nil {
+		fatal(t, err)
+	}
+	if _, err := other.PutLink(upspin.PathName(testDir), link); err != nil {
+		fatal(t, err)
+	}
+
+	c := newCachingClient(client.New(testConfig.cfg))
+	u := testConfig.cfg.UserName()
+	deadline := time.Now().Add(dirCacheTTL)
+	for {
+		if _, err := c.Lookup(fn, false); err != nil {
+			fatal(t, err)
+		}
+		c.mu.Lock()
+		active := c.watches[u].active
+		c.mu.Unlock()
+		if active {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Skip("directory server does not support Watch")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	viaLink := link + "/file"
+	for _, name := range []upspin.PathName{fn, viaLink} {
+		if _, err := c.Lookup(name, false); err != nil {
+			fatal(t, err)
+		}
+	}
+	if _, err := c.Glob(string(link) + "/*"); err != nil {
+		fatal(t, err)
+	}
+
+	entry, err := other.Put(fn, []byte("hello, world"))
+	if err != nil {
+		fatal(t, err)
+	}
+	fn2 := upspin.PathName(filepath.Join(testDir, "file2"))
+	if _, err := other.Put(fn2, nil); err != nil {
+		fatal(t, err)
+	}
+	deadline = time.Now().Add(dirCacheTTL / 2)
+	for _, name := range []upspin.PathName{fn, viaLink} {
+		for {
+			e, err := c.Lookup(name, false)
+			if err != nil {
+				fatal(t, err)
+			}
+			if e.Sequence == entry.Sequence {
+				break
+			}
+			if time.Now().After(deadline) {
+				fatalf(t, "%s: stale sequence %d, want %d", name, e.Sequence, entry.Sequence)
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+	}
+	if entries, err := c.Glob(string(link) + "/*"); err != nil || len(entries) != 2 {
+		fatalf(t, "listing %s through a link: %d entries, %v", testDir, len(entries), err)
+	}
+
+	for _, name := range []upspin.PathName{link, fn, fn2} {
+		if err := other.Delete(name); err != nil {
+			fatal(t, err)
+		}
+	}
+	remove(t, testDir)
+}
+
+func TestRemoveOnClose(t *testing.T) {
+	testDir := mkTestDir(t, "testrclose")
+	buf := randomBytes(t, 100)
+
+	fn := filepath.Join(testDir, "file")
+	f, err := testConfig.clnt.FCreate(fn, 0600, go9p.OWRITE|go9p.ORCLOSE)
+	if err != nil {
+		fatal(t, err)
+	}
+	if _, err := f.Write(buf); err != nil {
+		f.Close()
+		fatal(t, err)
+	}
+	if err := f.Close(); err != nil {
+		fatal(t, err)
+	}
+	notExist(t, fn, "close of ORCLOSE file")
+
+	// The file is removed once the last fid open on it is clunked.
+	mkFile(t, fn, buf)
+	f, err = testConfig.clnt.FOpen(fn, go9p.OREAD|go9p.ORCLOSE)
+	if err != nil {
+		fatal(t, err)
+	}
+	g, err := testConfig.clnt.FOpen(fn, go9p.OREAD)
+	if err != nil {
+		f.Close()
+		fatal(t, err)
+	}
+	if err := f.Close(); err != nil {
+		g.Close()
+		fatal(t, err)
+	}
+	readAndCheckContentsOrDie(t, fn, buf)
+	if err := g.Close(); err != nil {
+		fatal(t, err)
+	}
+	notExist(t, fn, "close of last fid")
+	remove(t, testDir)
+}
+
+func TestExclusive(t *testing.T) {
+	testDir := mkTestDir(t, "testexcl")
+	fn := filepath.Join(testDir, "file")
+	f, err := testConfig.clnt.FCreate(fn, 0600|go9p.DMEXCL, go9p.OWRITE)
+	if err != nil {
+		fatal(t, err)
+	}
+	if g, err := testConfig.clnt.FOpen(fn, go9p.OREAD); err == nil {
+		g.Close()
+		f.Close()
+		fatalf(t, "second open of exclusive file succeeded")
+	}
+	if err := f.Close(); err != nil {
+		fatal(t, err)
+	}
+	d, err := testConfig.clnt.FStat(fn)
+	if err != nil {
+		fatal(t, err)
+	}
+	if d.Mode&go9p.DMEXCL == 0 {
+		fatalf(t, "%s: mode %o lacks DMEXCL", fn, d.Mode)
+	}
+	readAndCheckContentsOrDie(t, fn, nil)
+	remove(t, fn)
+	remove(t, testDir)
+}
+
+func TestAppend(t *testing.T) {
+	testDir := mkTestDir(t, "testappend")
+	fn := filepath.Join(testDir, "file")
+	f, err := testConfig.clnt.FCreate(fn, 0600|go9p.DMAPPEND, go9p.OWRITE)
+	if err != nil {
+		fatal(t, err)
+	}
+	for _, s := range []string{"hello", ", world"} {
+		if _, err := f.WriteAt([]byte(s), 0); err != nil {
+			f.Close()
+			fatal(t, err)
+		}
+	}
+	if err := f.Close(); err != nil {
+		fatal(t, err)
+	}
+	d, err := testConfig.clnt.FStat(fn)
+	if err != nil {
+		fatal(t, err)
+	}
+	if d.Mode&go9p.DMAPPEND == 0 {
+		fatalf(t, "%s: mode %o lacks DMAPPEND", fn, d.Mode)
+	}
+	readAndCheckContentsOrDie(t, fn, []byte("hello, world"))
+	remove(t, fn)
+	remove(t, testDir)
+}
+
+// lock sends a Tlock of the whole file fid for client and returns its status.
+func (c *dotlClient) lock(t *testing.T, fid uint32, typ uint8, client string) uint8 {
+	var req lenc
+	req.u32(fid)
+	req.u8(typ)
+	req.u32(0) // flags
+	req.u64(0) // start
+	req.u64(0) // length
+	req.u32(1) // proc_id
+	req.str(client)
+	return c.rpc(t, Tlock, req).u8()
+}
+
+func TestLock(t *testing.T) {
+	testDir := mkTestDir(t, "testlock")
+	fn := filepath.Join(testDir, "file")
+	mkFile(t, fn, []byte("hello"))
+
+	a := dialDotL(t)
+	defer a.conn.Close()
+	a.walk(t, 0, 1, fn)
+	b := dialDotL(t)
+	defer b.conn.Close()
+	b.walk(t, 0, 1, fn)
+
+	if st := a.lock(t, 1, lockWrite, "a"); st != lockSuccess {
+		fatalf(t, "lock by a: status %d", st)
+	}
+	if st := b.lock(t, 1, lockRead, "b"); st != lockBlocked {
+		fatalf(t, "conflicting lock by b: status %d", st)
+	}
+	var req lenc
+	req.u32(1)
+	req.u8(lockRead)
+	req.u64(0)
+	req.u64(0)
+	req.u32(1)
+	req.str("b")
+	d := b.rpc(t, Tgetlock, req)
+	if typ := d.u8(); typ != lockWrite {
+		fatalf(t, "getlock: type %d, want %d", typ, lockWrite)
+	}
+	d.u64()
+	d.u64()
+	d.u32()
+	if client := d.str(); client != "a" {
+		fatalf(t, "getlock: held by %q, want %q", client, "a")
+	}
+	if st := a.lock(t, 1, lockUnlock, "a"); st != lockSuccess {
+		fatalf(t, "unlock by a: status %d", st)
+	}
+	if st := b.lock(t, 1, lockRead, "b"); st != lockSuccess {
+		fatalf(t, "lock by b: status %d", st)
+	}
+	remove(t, fn)
+	remove(t, testDir)
+}
+
 func TestWalkAfterCreate(t *testing.T) {
 	testDir := mkTestDir(t, "testfile")
 	fn := filepath.Join(testDir, "file")
@@ -319,10 +1168,149 @@ func TestRename(t *testing.T) {
 	if err := rename(original, newname); err != nil {
 		t.Fatal(err)
 	}
-	readAndCheckContentsOrDie(t, newname, []byte(original))
-	notExist(t, original, "rename")
-	remove(t, newname)
+	readAndCheckContentsOrDie(t, newname, []byte(original))
+	notExist(t, original, "rename")
+	remove(t, newname)
+
+	remove(t, testDir)
+}
+
+// TestRenameat tests that Trenameat replaces an existing file,
+// unless the rename fails.
+func TestRenameat(t *testing.T) {
+	testDir := mkTestDir(t, "testrenameat")
+	src := filepath.Join(testDir, "src")
+	dst := filepath.Join(testDir, "dst")
+	mkFile(t, src, []byte("src"))
+	mkFile(t, dst, []byte("dst"))
+
+	c := dialDotL(t)
+	defer c.conn.Close()
+	c.walk(t, 0, 1, testDir)
+	renameat := func(oldname, newname string) uint32 {
+		var req lenc
+		req.u32(1)
+		req.str(oldname)
+		req.u32(1)
+		req.str(newname)
+		_, errno := c.call(t, Trenameat, req)
+		return errno
+	}
+	if errno := renameat("nosuch", "dst"); errno == 0 {
+		fatalf(t, "renameat of a missing file succeeded")
+	}
+	readAndCheckContentsOrDie(t, dst, []byte("dst"))
+
+	if errno := renameat("src", "dst"); errno != 0 {
+		fatalf(t, "renameat failed: errno %d", errno)
+	}
+	readAndCheckContentsOrDie(t, dst, []byte("src"))
+	notExist(t, src, "renameat")
+	left, err := client.New(testConfig.cfg).Glob(testDir + "/*")
+	if err != nil {
+		fatal(t, err)
+	}
+	if len(left) != 1 {
+		fatalf(t, "renameat left %d files, want 1", len(left))
+	}
+	remove(t, dst)
+	remove(t, testDir)
+}
+
+func wstat(fn string, d *go9p.Dir) error {
+	fid, err := testConfig.clnt.FWalk(fn)
+	if err != nil {
+		return err
+	}
+	defer testConfig.clnt.Clunk(fid)
+	return testConfig.clnt.Wstat(fid, d)
+}
+
+func TestWstat(t *testing.T) {
+	testDir := mkTestDir(t, "testwstat")
+	buf := randomBytes(t, 100)
+	fn := filepath.Join(testDir, "file")
+	mkFile(t, fn, buf)
+
+	// Truncate and extend.
+	d := go9p.NewWstatDir()
+	d.Length = 10
+	if err := wstat(fn, d); err != nil {
+		fatal(t, err)
+	}
+	readAndCheckContentsOrDie(t, fn, buf[:10])
+	d.Length = 20
+	if err := wstat(fn, d); err != nil {
+		fatal(t, err)
+	}
+	readAndCheckContentsOrDie(t, fn, append(buf[:10], make([]byte, 10)...))
+
+	const mtime = 1000000000
+	d = go9p.NewWstatDir()
+	d.Mtime = mtime
+	if err := wstat(fn, d); err != nil {
+		fatal(t, err)
+	}
+	st, err := testConfig.clnt.FStat(fn)
+	if err != nil {
+		fatal(t, err)
+	}
+	if st.Mtime != mtime {
+		fatalf(t, "mtime is %d, want %d", st.Mtime, mtime)
+	}
+
+	// A wstat changing nothing succeeds, as does setting the current mode.
+	if err := wstat(fn, go9p.NewWstatDir()); err != nil {
+		fatal(t, err)
+	}
+	d = go9p.NewWstatDir()
+	d.Mode = st.Mode
+	if err := wstat(fn, d); err != nil {
+		fatal(t, err)
+	}
+	d.Mode = st.Mode ^ 0007
+	if err := wstat(fn, d); err == nil {
+		fatalf(t, "changing mode succeeded")
+	}
+	d.Mode = st.Mode | go9p.DMDIR
+	if err := wstat(fn, d); err == nil {
+		fatalf(t, "changing a file into a directory succeeded")
+	}
+	remove(t, fn)
+	remove(t, testDir)
+}
+
+// TestMode tests that permissions are derived from Access files.
+func TestMode(t *testing.T) {
+	testDir := mkTestDir(t, "testmode")
+	owner := string(testConfig.cfg.UserName())
+
+	fn := filepath.Join(testDir, "file")
+	mkFile(t, fn, []byte("private"))
+	d, err := testConfig.clnt.FStat(fn)
+	if err != nil {
+		fatal(t, err)
+	}
+	if d.Uid != owner || d.Mode&0777 != 0770 {
+		fatalf(t, "%s: owner %s mode %o, want %s 0770", fn, d.Uid, d.Mode&0777, owner)
+	}
+	remove(t, fn)
 
+	sub := filepath.Join(testDir, "shared")
+	mkDir(t, sub)
+	mkFile(t, filepath.Join(sub, "Access"), []byte("r: all\nw,l: "+owner+"\n"))
+	fn = filepath.Join(sub, "file")
+	mkFile(t, fn, []byte("public"))
+	d, err = testConfig.clnt.FStat(fn)
+	if err != nil {
+		fatal(t, err)
+	}
+	if d.Mode&0777 != 0774 {
+		fatalf(t, "%s: mode %o, want 0774", fn, d.Mode&0777)
+	}
+	remove(t, fn)
+	remove(t, filepath.Join(sub, "Access"))
+	remove(t, sub)
 	remove(t, testDir)
 }
 
@@ -376,6 +1364,660 @@ func TestMultiWrites(t *testing.T) {
 	remove(t, testDir)
 }
 
+// TestAuth tests the upspin-sig1 authentication protocol.
+func TestAuth(t *testing.T) {
+	cfg := testConfig.cfg
+	fs := newUpspinFS(cfg, &options{
+		allow: map[upspin.UserName]bool{cfg.UserName(): true},
+	})
+	if err := fs.authCheck(string(cfg.UserName()), nil, nil); err == nil {
+		fatalf(t, "attach without authentication succeeded")
+	}
+
+	respond := func(a *authState, u upspin.UserName) []byte {
+		sig, err := cfg.Factotum().Sign(authHash(u, a.challenge))
+		if err != nil {
+			fatal(t, err)
+		}
+		return []byte(fmt.Sprintf("%x %x\n", sig.R, sig.S))
+	}
+
+	// A signature over the wrong user name must be rejected.
+	a, err := fs.authInit("")
+	if err != nil {
+		fatal(t, err)
+	}
+	if _, err := fs.authWrite(a, respond(a, "bob@example.com")); err != nil {
+		fatal(t, err)
+	}
+	if err := fs.authCheck(string(cfg.UserName()), nil, a); err == nil {
+		fatalf(t, "attach succeeded after failed authentication")
+	}
+
+	a, err = fs.authInit("")
+	if err != nil {
+		fatal(t, err)
+	}
+	if _, err := fs.authWrite(a, respond(a, cfg.UserName())); err != nil {
+		fatal(t, err)
+	}
+	if _, err := fs.authWrite(a, respond(a, cfg.UserName())); err == nil {
+		fatalf(t, "second response accepted")
+	}
+	if err := fs.authCheck(string(cfg.UserName()), nil, a); err != nil {
+		fatal(t, err)
+	}
+	if err := fs.authCheck("bob@example.com", nil, a); err == nil {
+		fatalf(t, "attach as a different user succeeded")
+	}
+}
+
+// TestAuthAttach tests authenticating and attaching through go9p
+// in 9P2000.u, which sends the numeric uid along with the uname.
+func TestAuthAttach(t *testing.T) {
+	cfg := testConfig.cfg
+	fs := newUpspinFS(cfg, &options{
+		allow: map[upspin.UserName]bool{cfg.UserName(): true},
+	})
+	if !fs.Start(fs) {
+		fatalf(t, "start failed")
+	}
+	sc, cc := net.Pipe()
+	go fs.serveConn(sc)
+	c, err := clnt.Connect(cc, 8192, true)
+	if err != nil {
+		fatal(t, err)
+	}
+	defer c.Unmount()
+
+	u := TestUser(cfg.UserName())
+	if _, err := c.Attach(nil, u, ""); err == nil {
+		fatalf(t, "attach without authentication succeeded")
+	}
+	afid, err := c.Auth(u, "")
+	if err != nil {
+		fatal(t, err)
+	}
+	challenge, err := c.Read(afid, 0, 8192)
+	if err != nil {
+		fatal(t, err)
+	}
+	sig, err := cfg.Factotum().Sign(authHash(cfg.UserName(), challenge))
+	if err != nil {
+		fatal(t, err)
+	}
+	if _, err := c.Write(afid, []byte(fmt.Sprintf("%x %x\n", sig.R, sig.S)), 0); err != nil {
+		fatal(t, err)
+	}
+	if _, err := c.Attach(afid, TestUser("bob@example.com"), ""); err == nil {
+		fatalf(t, "attach as a different user succeeded")
+	}
+	if _, err := c.Attach(afid, u, ""); err != nil {
+		fatal(t, err)
+	}
+}
+
+// TestIdentity tests choosing the Upspin user from the attach uname.
+func TestIdentity(t *testing.T) {
+	dir, err := ioutil.TempDir("", "9upspinfs")
+	if err != nil {
+		fatal(t, err)
+	}
+	defer os.RemoveAll(dir)
+	uname := testConfig.cfg.UserName()
+	if err := os.MkdirAll(filepath.Join(dir, string(uname)), 0700); err != nil {
+		fatal(t, err)
+	}
+	cfg := fmt.Sprintf("username: %s\nkeyserver: inprocess\ndirserver: inprocess\nstoreserver: inprocess\npacking: ee\nsecrets: %s\n",
+		uname, testutil.Repo("key", "testdata", "user1"))
+	if err := ioutil.WriteFile(filepath.Join(dir, string(uname), "config"), []byte(cfg), 0600); err != nil {
+		fatal(t, err)
+	}
+
+	fs := newUpspinFS(testConfig.cfg, &options{usersDir: dir})
+	id, err := fs.identity(string(uname))
+	if err != nil {
+		fatal(t, err)
+	}
+	if id == fs.owner || id.cfg.UserName() != uname {
+		fatalf(t, "attach as %s did not use its own config", uname)
+	}
+	if id2, _ := fs.identity(string(uname)); id2 != id {
+		fatalf(t, "second attach as %s did not reuse its identity", uname)
+	}
+	if _, err := fs.identity("nobody@example.com"); err == nil {
+		fatalf(t, "attach as user without config succeeded")
+	}
+}
+
+// TestReadOnly tests that a read-only server rejects every change.
+func TestReadOnly(t *testing.T) {
+	testDir := mkTestDir(t, "readonly")
+	fn := filepath.Join(testDir, "file")
+	buf := randomBytes(t, 100)
+	mkFile(t, fn, buf)
+
+	fs := newUpspinFS(testConfig.cfg, &options{readOnly: true})
+	walk := func(name string) *Fid {
+		fid, qids, err := fs.walk(&Fid{id: fs.owner}, strings.Split(name, "/"))
+		if err != nil || len(qids) != len(strings.Split(name, "/")) {
+			fatalf(t, "walk %s: %v", name, err)
+		}
+		return fid
+	}
+	file := walk(fn)
+	if err := fs.open(file, go9p.OWRITE); err != errReadOnlyServer {
+		fatalf(t, "open for writing = %v, want %v", err, errReadOnlyServer)
+	}
+	if err := fs.open(file, go9p.OREAD|go9p.ORCLOSE); err != errReadOnlyServer {
+		fatalf(t, "open with ORCLOSE = %v, want %v", err, errReadOnlyServer)
+	}
+	if err := fs.open(file, go9p.OREAD); err != nil {
+		fatal(t, err)
+	}
+	rbuf := make([]byte, len(buf))
+	if n, err := fs.read(file, rbuf, 0); err != nil || !bytes.Equal(rbuf[:n], buf) {
+		fatalf(t, "read %d bytes, %v", n, err)
+	}
+	fs.clunk(file)
+	if err := fs.truncate(walk(fn), 0); err != errReadOnlyServer {
+		fatalf(t, "truncate = %v, want %v", err, errReadOnlyServer)
+	}
+	if err := fs.remove(walk(fn)); err != errReadOnlyServer {
+		fatalf(t, "remove = %v, want %v", err, errReadOnlyServer)
+	}
+	if err := fs.create(walk(testDir), "new", 0600, go9p.OWRITE); err != errReadOnlyServer {
+		fatalf(t, "create = %v, want %v", err, errReadOnlyServer)
+	}
+	readAndCheckContentsOrDie(t, fn, buf)
+}
+
+// TestExport tests attaching to a subtree selected by the aname.
+func TestExport(t *testing.T) {
+	testDir := mkTestDir(t, "export")
+	buf := randomBytes(t, 100)
+	mkFile(t, filepath.Join(testDir, "file"), buf)
+
+	exports, err := parseExports("# name path options\nproj " + testDir + " readonly\n")
+	if err != nil {
+		fatal(t, err)
+	}
+	fs := newUpspinFS(testConfig.cfg, &options{exports: exports})
+	root, err := fs.attach("", "proj", nil)
+	if err != nil {
+		fatal(t, err)
+	}
+	if root.path != upspin.PathName(testDir) {
+		fatalf(t, "attach to proj got %s, want %s", root.path, testDir)
+	}
+	fid, qids, err := fs.walk(root, []string{"..", "..", "file"})
+	if err != nil || len(qids) != 3 || fid.path != upspin.PathName(filepath.Join(testDir, "file")) {
+		fatalf(t, "walk out of export reached %s, %v", fid.path, err)
+	}
+	if err := fs.create(root.clone(), "new", 0600, go9p.OWRITE); err != errReadOnlyServer {
+		fatalf(t, "create in read-only export = %v, want %v", err, errReadOnlyServer)
+	}
+
+	// With a table, its exports cannot be reached by other anames,
+	// which would bypass their options.
+	for _, aname := range []string{testDir, ""} {
+		if _, err := fs.attach("", aname, nil); err != errNoExport {
+			fatalf(t, "attach to %q = %v, want %v", aname, err, errNoExport)
+		}
+	}
+
+	// An Upspin path is an export with no options.
+	fs = newUpspinFS(testConfig.cfg, &options{})
+	sub := filepath.Join(testDir, "sub")
+	mkDir(t, sub)
+	root, err = fs.attach("", sub, nil)
+	if err != nil {
+		fatal(t, err)
+	}
+	fid = root.clone()
+	if err := fs.create(fid, "new", 0600, go9p.OWRITE); err != nil {
+		fatal(t, err)
+	}
+	fs.clunk(fid)
+	if err := fs.rename(root.clone(), "other@example.com/new"); err == nil {
+		fatalf(t, "rename out of export succeeded")
+	}
+
+	// Names cannot reach out of the export once cleaned.
+	for _, name := range []string{"../file", "../x", ".", "a/b"} {
+		if fid, qids, err := fs.walk(root, []string{name}); err == nil {
+			fatalf(t, "walk to %q reached %s, %d qids", name, fid.path, len(qids))
+		}
+		if err := fs.create(root.clone(), name, 0600, go9p.OWRITE); err == nil {
+			fatalf(t, "create of %q succeeded", name)
+		}
+	}
+	if err := fs.checkWritable(root, upspin.PathName(sub+"/../x")); err == nil {
+		fatalf(t, "%s/../x is writable in export %s", sub, sub)
+	}
+	notExist(t, filepath.Join(testDir, "x"), "create out of export")
+	remove(t, filepath.Join(sub, "new"))
+	remove(t, sub)
+	if _, err := fs.attach("", "nosuchexport", nil); err == nil {
+		fatalf(t, "attach to unknown export succeeded")
+	}
+	if _, err := parseExports("proj " + testDir + " bogus\n"); err == nil {
+		fatalf(t, "bad export option accepted")
+	}
+}
+
+// dotlClient is a minimal 9P2000.L client used to test dotl.go.
+type dotlClient struct {
+	conn net.Conn
+}
+
+func (c *dotlClient) rpc(t *testing.T, typ uint8, req lenc) *ldec {
+	d, errno := c.call(t, typ, req)
+	if errno != 0 {
+		fatalf(t, "request type %d failed: errno %d", typ, errno)
+	}
+	return d
+}
+
+// call sends a request and returns the reply, or the errno of Rlerror.
+func (c *dotlClient) call(t *testing.T, typ uint8, req lenc) (*ldec, uint32) {
+	var msg lenc
+	msg.u32(uint32(7 + len(req)))
+	msg.u8(typ)
+	msg.u16(1)
+	msg = append(msg, req...)
+	if _, err := c.conn.Write(msg); err != nil {
+		fatal(t, err)
+	}
+	resp, err := readMsg(c.conn, dotlMsize)
+	if err != nil {
+		fatal(t, err)
+	}
+	switch resp[4] {
+	case Rlerror:
+		d := &ldec{b: resp[7:]}
+		return nil, d.u32()
+	case go9p.Rerror:
+		// A 9P2000 error, which has no errno.
+		return nil, go9p.EIO
+	}
+	if resp[4] != typ+1 {
+		fatalf(t, "got reply type %d to request type %d", resp[4], typ)
+	}
+	return &ldec{b: resp[7:]}, 0
+}
+
+// dialDotL connects to the server using 9P2000.L and attaches
+// the root to fid 0.
+func dialDotL(t *testing.T) *dotlClient {
+	conn, err := net.Dial("tcp", serverAddr)
+	if err != nil {
+		fatal(t, err)
+	}
+	c := &dotlClient{conn: conn}
+
+	var req lenc
+	req.u32(8192)
+	req.str(dotlVersion)
+	if d := c.rpc(t, go9p.Tversion, req); d.u32() == 0 || d.str() != dotlVersion {
+		conn.Close()
+		fatalf(t, "bad Rversion")
+	}
+
+	req = nil
+	req.u32(0) // fid
+	req.u32(go9p.NOFID)
+	req.str("")
+	req.str("")
+	req.u32(go9p.NOUID)
+	c.rpc(t, go9p.Tattach, req)
+	return c
+}
+
+// walk walks fid to newfid through the path elements of name.
+func (c *dotlClient) walk(t *testing.T, fid, newfid uint32, name string) {
+	names := strings.Split(name, "/")
+	var req lenc
+	req.u32(fid)
+	req.u32(newfid)
+	req.u16(uint16(len(names)))
+	for _, n := range names {
+		req.str(n)
+	}
+	if d := c.rpc(t, go9p.Twalk, req); int(d.u16()) != len(names) {
+		fatalf(t, "walk to %s failed", name)
+	}
+}
+
+// TestDotL tests walking, creating, and listing files using 9P2000.L.
+func TestDotL(t *testing.T) {
+	c := dialDotL(t)
+	defer c.conn.Close()
+	c.walk(t, 0, 1, string(testConfig.cfg.UserName()))
+
+	var req lenc
+	req.u32(1)
+	req.str("testdotl")
+	req.u32(0755)
+	req.u32(0)
+	c.rpc(t, Tmkdir, req)
+
+	req = nil
+	req.u32(1)
+	req.u64(getattrBasic)
+	d := c.rpc(t, Tgetattr, req)
+	d.u64() // valid
+	d.bytes(13)
+	mode := d.u32()
+	if mode&sIFDIR == 0 {
+		fatalf(t, "user root mode is %o, want a directory", mode)
+	}
+	// The attaching user, here with uid 0, owns every file, with
+	// the rights of its Upspin user in the owner bits.
+	if mode&0700 != 0700 {
+		fatalf(t, "user root mode is %o, want owner bits 0700", mode)
+	}
+	if uid, gid := d.u32(), d.u32(); uid != 0 || gid != nobodyGID {
+		fatalf(t, "user root uid %d gid %d, want 0 and %d", uid, gid, nobodyGID)
+	}
+
+	req = nil
+	req.u32(1)
+	req.u32(0)
+	c.rpc(t, Tlopen, req)
+
+	req = nil
+	req.u32(1)
+	req.u64(0)
+	req.u32(8192)
+	d = c.rpc(t, Treaddir, req)
+	d = &ldec{b: d.bytes(int(d.u32()))}
+	found := false
+	for len(d.b) > 0 && d.err == nil {
+		d.bytes(13 + 8 + 1) // qid, offset, type
+		if d.str() == "testdotl" {
+			found = true
+		}
+	}
+	if !found {
+		fatalf(t, "testdotl not found in Rreaddir")
+	}
+
+	req = nil
+	req.u32(1)
+	req.str("testdotl")
+	req.u32(0x200) // AT_REMOVEDIR
+	c.rpc(t, Tunlinkat, req)
+	notExist(t, filepath.Join(testConfig.root, "testdotl"), "unlinkat")
+
+	// An msize leaving no room for data is refused.
+	req = nil
+	req.u32(go9p.IOHDRSZ - 1)
+	req.str(dotlVersion)
+	if _, errno := c.call(t, go9p.Tversion, req); errno == 0 {
+		fatalf(t, "Tversion with msize %d succeeded", go9p.IOHDRSZ-1)
+	}
+}
+
+// TestSymlink tests creating and reading links as symbolic links.
+func TestSymlink(t *testing.T) {
+	testDir := mkTestDir(t, "testlink")
+	buf := randomBytes(t, 100)
+	fn := filepath.Join(testDir, "file")
+	mkFile(t, fn, buf)
+
+	c := dialDotL(t)
+	defer c.conn.Close()
+	c.walk(t, 0, 1, testDir)
+
+	var req lenc
+	req.u32(1)
+	req.str("link")
+	req.str("file")
+	req.u32(0)
+	c.rpc(t, Tsymlink, req)
+
+	link := filepath.Join(testDir, "link")
+	entry, err := client.New(testConfig.cfg).Lookup(upspin.PathName(link), false)
+	if err != nil {
+		fatal(t, err)
+	}
+	if !entry.IsLink() || entry.Link != upspin.PathName(fn) {
+		fatalf(t, "%s: got link to %q, want %q", link, entry.Link, fn)
+	}
+
+	c.walk(t, 1, 2, "link")
+	req = nil
+	req.u32(2)
+	if target := c.rpc(t, Treadlink, req).str(); target != "file" {
+		fatalf(t, "readlink returned %q, want %q", target, "file")
+	}
+	req = nil
+	req.u32(2)
+	req.u64(getattrBasic)
+	d := c.rpc(t, Tgetattr, req)
+	d.u64() // valid
+	d.bytes(13)
+	if mode := d.u32(); mode&sIFMT != sIFLNK {
+		fatalf(t, "link mode is %o, want a symbolic link", mode)
+	}
+
+	// 9P2000 clients see the link and read through it.
+	dir, err := testConfig.clnt.FStat(link)
+	if err != nil {
+		fatal(t, err)
+	}
+	if dir.Mode&go9p.DMSYMLINK == 0 {
+		fatalf(t, "%s: mode %o lacks DMSYMLINK", link, dir.Mode)
+	}
+	readAndCheckContentsOrDie(t, link, buf)
+
+	remove(t, link)
+	remove(t, fn)
+	remove(t, testDir)
+}
+
+// xattr returns the extended attribute name of fid, read through newfid.
+func (c *dotlClient) xattr(t *testing.T, fid, newfid uint32, name string) string {
+	var req lenc
+	req.u32(fid)
+	req.u32(newfid)
+	req.str(name)
+	size := c.rpc(t, Txattrwalk, req).u64()
+	req = nil
+	req.u32(newfid)
+	req.u64(0)
+	req.u32(uint32(size))
+	d := c.rpc(t, go9p.Tread, req)
+	value := d.bytes(int(d.u32()))
+	req = nil
+	req.u32(newfid)
+	c.rpc(t, go9p.Tclunk, req)
+	return string(value)
+}
+
+func TestXattr(t *testing.T) {
+	testDir := mkTestDir(t, "testxattr")
+	fn := filepath.Join(testDir, "file")
+	mkFile(t, fn, randomBytes(t, 100))
+
+	c := dialDotL(t)
+	defer c.conn.Close()
+	c.walk(t, 0, 1, fn)
+
+	list := c.xattr(t, 1, 2, "")
+	for _, name := range []string{"packing", "sequence", "writer", "blocks", "refs"} {
+		if !strings.Contains(list, xattrPrefix+name+"\x00") {
+			fatalf(t, "attribute list %q lacks %s", list, name)
+		}
+	}
+	if writer := c.xattr(t, 1, 2, xattrPrefix+"writer"); writer != string(testConfig.cfg.UserName()) {
+		fatalf(t, "writer is %q, want %q", writer, testConfig.cfg.UserName())
+	}
+	if blocks := c.xattr(t, 1, 2, xattrPrefix+"blocks"); blocks != "1" {
+		fatalf(t, "file has %q blocks, want 1", blocks)
+	}
+	if refs := c.xattr(t, 1, 2, xattrPrefix+"refs"); strings.Count(refs, "\n") != 1 {
+		fatalf(t, "refs %q does not describe one block", refs)
+	}
+
+	remove(t, fn)
+	remove(t, testDir)
+}
+
+func TestInfo(t *testing.T) {
+	testDir := mkTestDir(t, "testinfo")
+	fn := filepath.Join(testDir, "file")
+	mkFile(t, fn, randomBytes(t, 100))
+
+	info := filepath.Join(infoRoot, testDir)
+	dir, err := testConfig.clnt.FStat(info)
+	if err != nil {
+		fatal(t, err)
+	}
+	if dir.Mode&go9p.DMDIR == 0 {
+		fatalf(t, "%s: mode %o lacks DMDIR", info, dir.Mode)
+	}
+	f, err := testConfig.clnt.FOpen(filepath.Join(info, "file"), go9p.OREAD)
+	if err != nil {
+		fatal(t, err)
+	}
+	buf := make([]byte, 8192)
+	n, err := f.Read(buf)
+	f.Close()
+	if err != nil && err != io.EOF {
+		fatal(t, err)
+	}
+	text := string(buf[:n])
+	for _, want := range []string{fn + "\n", "\tsize: 100\n", "\twriter: " + string(testConfig.cfg.UserName()) + "\n", "\tblock 0: "} {
+		if !strings.Contains(text, want) {
+			fatalf(t, "info of %s lacks %q:\n%s", fn, want, text)
+		}
+	}
+	if _, err := testConfig.clnt.FOpen(filepath.Join(info, "file"), go9p.OWRITE); err == nil {
+		fatalf(t, "info file opened for writing")
+	}
+	if _, err := testConfig.clnt.FCreate(filepath.Join(info, "new"), 0600, go9p.OWRITE); err == nil {
+		fatalf(t, "file created in info tree")
+	}
+
+	remove(t, fn)
+	remove(t, testDir)
+}
+
+func TestAccessFile(t *testing.T) {
+	testDir := mkTestDir(t, "testaccess")
+	acc := filepath.Join(testDir, "Access")
+
+	// A malformed Access file is refused as it is written,
+	// once the malformed line is complete.
+	f, err := testConfig.clnt.FCreate(acc, 0600, go9p.OWRITE)
+	if err != nil {
+		fatal(t, err)
+	}
+	line := []byte("read: bob@example.com\n")
+	if _, err := f.Writen(line, 0); err != nil {
+		fatal(t, err)
+	}
+	if _, err := f.Writen([]byte("bog"), uint64(len(line))); err != nil {
+		fatal(t, err)
+	}
+	if _, err := f.Writen([]byte("bogus\n"), uint64(len(line))); err == nil {
+		fatalf(t, "malformed Access file accepted")
+	}
+	// The refused write changed nothing.
+	if _, err := f.Writen([]byte("list: bob@example.com\n"), uint64(len(line))); err != nil {
+		fatal(t, err)
+	}
+	if err := f.Close(); err != nil {
+		fatal(t, err)
+	}
+
+	mkFile(t, acc, []byte("read,list: bob@example.com\n"))
+	f, err = testConfig.clnt.FOpen(filepath.Join(testDir, effectiveFile), go9p.OREAD)
+	if err != nil {
+		fatal(t, err)
+	}
+	buf := make([]byte, 8192)
+	n, err := f.Read(buf)
+	f.Close()
+	if err != nil && err != io.EOF {
+		fatal(t, err)
+	}
+	text := string(buf[:n])
+	for _, want := range []string{"governed by: " + acc + "\n", "\tbob@example.com read,list\n"} {
+		if !strings.Contains(text, want) {
+			fatalf(t, "%s lacks %q:\n%s", effectiveFile, want, text)
+		}
+	}
+	if _, err := testConfig.clnt.FCreate(filepath.Join(testDir, effectiveFile), 0600, go9p.OWRITE); err == nil {
+		fatalf(t, "created %s", effectiveFile)
+	}
+
+	remove(t, acc)
+	remove(t, testDir)
+}
+
+func TestLinkTarget(t *testing.T) {
+	tests := []struct {
+		name, link upspin.PathName
+		target     string
+	}{
+		{"ann@example.com/a/link", "ann@example.com/a/file", "file"},
+		{"ann@example.com/a/link", "ann@example.com/b/c", "../b/c"},
+		{"ann@example.com/link", "bob@example.com/d", "../bob@example.com/d"},
+	}
+	for _, test := range tests {
+		d := &upspin.DirEntry{Name: test.name, Link: test.link, Attr: upspin.AttrLink}
+		if got := linkTarget(d); got != test.target {
+			t.Errorf("linkTarget(%s -> %s) = %q, want %q", test.name, test.link, got, test.target)
+		}
+		if got, err := resolveLink(test.name, test.target); err != nil || got != test.link {
+			t.Errorf("resolveLink(%s, %q) = %q, %v, want %q", test.name, test.target, got, err, test.link)
+		}
+	}
+	if _, err := resolveLink("ann@example.com/link", "../../x"); err == nil {
+		t.Errorf("resolveLink outside the tree succeeded")
+	}
+}
+
+func TestSnapshotRoot(t *testing.T) {
+	tests := []struct {
+		dir, root upspin.PathName
+	}{
+		{"ann@example.com/", "ann+snapshot@example.com"},
+		{"ann@example.com", "ann+snapshot@example.com"},
+		{"ann+work@example.com/", ""},
+		{"ann@example.com/a", ""},
+		{"ann+snapshot@example.com/", ""},
+	}
+	for _, test := range tests {
+		if got := snapshotRoot(test.dir); got != test.root {
+			t.Errorf("snapshotRoot(%s) = %q, want %q", test.dir, got, test.root)
+		}
+	}
+	parents := []struct {
+		dir, parent upspin.PathName
+	}{
+		{"ann+snapshot@example.com", "ann@example.com"},
+		{"ann+snapshot@example.com/", "ann@example.com"},
+		{"ann+snapshot@example.com/2018", ""},
+		{"ann@example.com", ""},
+		{"ann+work@example.com", ""},
+	}
+	for _, test := range parents {
+		if got := snapshotParent(test.dir); got != test.parent {
+			t.Errorf("snapshotParent(%s) = %q, want %q", test.dir, got, test.parent)
+		}
+	}
+	if err := (&upspinFS{}).checkWritable(&Fid{}, "ann+snapshot@example.com/2018/01/02/f"); err != errReadOnly {
+		t.Errorf("checkWritable in a snapshot = %v, want %v", err, errReadOnly)
+	}
+	if err := (&upspinFS{}).checkWritable(&Fid{}, "ann@example.com/f"); err != nil {
+		t.Errorf("checkWritable = %v, want nil", err)
+	}
+}
+
 func fatal(t *testing.T, args ...interface{}) {
 	t.Log(fmt.Sprintln(args...))
 	t.Log(string(rtdebug.Stack()))
@@ -0,0 +1,245 @@
+// Copyright 2018 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"upspin.io/bind"
+	"upspin.io/factotum"
+	"upspin.io/upspin"
+	"upspin.io/user"
+
+	go9p "github.com/lionkov/go9p/p"
+	"github.com/lionkov/go9p/p/srv"
+)
+
+// The authentication protocol, upspin-sig1, proves that the client holds
+// the Upspin key of the user named in Tattach. Reading the auth fid yields
+// a challenge line
+//
+//	upspin-sig1 <server user> <random nonce in hex>
+//
+// The client signs the SHA-256 hash of its user name, a newline, and the
+// challenge line (including its newline) with its factotum, and writes
+// back the signature as "<R in hex> <S in hex>\n". When the client
+// attaches, the signature is checked against the public key registered
+// in the key server for the uname of the attach. The uname of Tauth is
+// ignored, since go9p replaces it with the numeric uid under 9P2000.u.
+
+var (
+	errAuthRequired = &go9p.Error{Err: "authentication required", Errornum: go9p.EPERM}
+	errAuthFailed   = &go9p.Error{Err: "authentication failed", Errornum: go9p.EPERM}
+	errNotAllowed   = &go9p.Error{Err: "user not allowed to attach", Errornum: go9p.EPERM}
+)
+
+var authQidPath uint64
+
+// authState is the state of an authentication fid.
+type authState struct {
+	challenge []byte
+	qid       go9p.Qid
+
+	mu   sync.Mutex
+	resp []byte // response written so far
+	done bool   // whether the whole response has been written
+}
+
+// parseAllow parses the comma-separated list of users given to the -allow flag.
+func parseAllow(s string) (map[upspin.UserName]bool, error) {
+	allow := make(map[upspin.UserName]bool)
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		u, err := user.Clean(upspin.UserName(name))
+		if err != nil {
+			return nil, err
+		}
+		allow[u] = true
+	}
+	return allow, nil
+}
+
+// authRequired reports whether clients must authenticate
+// before attaching to the export e.
+func (f *upspinFS) authRequired(e *export) bool {
+	return len(f.allowed(e)) > 0
+}
+
+// authInit starts an authentication for an attach of aname.
+func (f *upspinFS) authInit(aname string) (*authState, error) {
+	e, err := f.export(aname)
+	if err != nil {
+		return nil, err
+	}
+	if !f.authRequired(e) {
+		return nil, srv.Enoauth
+	}
+	nonce := make([]byte, 32)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return &authState{
+		challenge: []byte(fmt.Sprintf("upspin-sig1 %s %x\n", f.cfg.UserName(), nonce)),
+		qid: go9p.Qid{
+			Type: go9p.QTAUTH,
+			Path: atomic.AddUint64(&authQidPath, 1),
+		},
+	}, nil
+}
+
+// authCheck checks that an attach to the export e by the 9P user uname
+// is permitted by the authentication fid a, which is nil if none was
+// given: uname must be allowed, and the response written to a must be
+// its signature of the challenge. Every attach is authorized here.
+func (f *upspinFS) authCheck(uname string, e *export, a *authState) error {
+	if !f.authRequired(e) {
+		return nil
+	}
+	if a == nil {
+		return errAuthRequired
+	}
+	u, err := user.Clean(upspin.UserName(uname))
+	if err != nil || !f.allowed(e)[u] {
+		return errNotAllowed
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if !a.done {
+		return errAuthFailed
+	}
+	return f.authVerify(u, a.challenge, a.resp)
+}
+
+// read reads the challenge.
+func (a *authState) read(b []byte, off int64) (int, error) {
+	if off >= int64(len(a.challenge)) {
+		return 0, nil
+	}
+	return copy(b, a.challenge[off:]), nil
+}
+
+// authWrite accumulates the client's response, a single line,
+// which is verified when the client attaches.
+func (f *upspinFS) authWrite(a *authState, b []byte) (int, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.done {
+		return 0, errAuthFailed
+	}
+	a.resp = append(a.resp, b...)
+	i := bytes.IndexByte(a.resp, '\n')
+	if i < 0 {
+		if len(a.resp) > 1024 {
+			return 0, errAuthFailed
+		}
+		return len(b), nil
+	}
+	a.resp = a.resp[:i]
+	a.done = true
+	return len(b), nil
+}
+
+// authVerify verifies that resp is a signature of challenge by user.
+func (f *upspinFS) authVerify(u upspin.UserName, challenge, resp []byte) error {
+	fields := strings.Fields(string(resp))
+	if len(fields) != 2 {
+		return errAuthFailed
+	}
+	var sig upspin.Signature
+	var ok1, ok2 bool
+	sig.R, ok1 = new(big.Int).SetString(fields[0], 16)
+	sig.S, ok2 = new(big.Int).SetString(fields[1], 16)
+	if !ok1 || !ok2 {
+		return errAuthFailed
+	}
+	key, err := f.keyServer()
+	if err != nil {
+		return err
+	}
+	ku, err := key.Lookup(u)
+	if err != nil {
+		return errAuthFailed
+	}
+	if err := factotum.Verify(authHash(u, challenge), sig, ku.PublicKey); err != nil {
+		return errAuthFailed
+	}
+	return nil
+}
+
+// keyServer returns the key server of the server's config.
+func (f *upspinFS) keyServer() (upspin.KeyServer, error) {
+	return bind.KeyServer(f.cfg, f.cfg.KeyEndpoint())
+}
+
+// authHash returns the hash signed by a client authenticating as u.
+func authHash(u upspin.UserName, challenge []byte) []byte {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\n", u)
+	h.Write(challenge)
+	return h.Sum(nil)
+}
+
+// The methods below implement srv.AuthOps.
+
+func (f *upspinFS) AuthInit(afid *srv.Fid, aname string) (*go9p.Qid, error) {
+	a, err := f.authInit(aname)
+	if err != nil {
+		return nil, err
+	}
+	afid.Aux = a
+	return &a.qid, nil
+}
+
+func (f *upspinFS) AuthDestroy(afid *srv.Fid) {
+}
+
+// AuthCheck leaves the check to Attach, which knows the uname
+// of the attach rather than the numeric uid of 9P2000.u.
+func (f *upspinFS) AuthCheck(fid *srv.Fid, afid *srv.Fid, aname string) error {
+	return nil
+}
+
+func (f *upspinFS) AuthRead(afid *srv.Fid, offset uint64, data []byte) (int, error) {
+	a, ok := afid.Aux.(*authState)
+	if !ok {
+		return 0, srv.Ebaduse
+	}
+	return a.read(data, int64(offset))
+}
+
+func (f *upspinFS) AuthWrite(afid *srv.Fid, offset uint64, data []byte) (int, error) {
+	a, ok := afid.Aux.(*authState)
+	if !ok {
+		return 0, srv.Ebaduse
+	}
+	return f.authWrite(a, data)
+}
+
+// userPool is a go9p user pool that accepts any user name,
+// since 9P users are Upspin users rather than local accounts.
+type userPool struct{}
+
+type user9p string
+
+func (u user9p) Name() string               { return string(u) }
+func (u user9p) Id() int                    { return -1 }
+func (u user9p) Groups() []go9p.Group       { return nil }
+func (u user9p) IsMember(g go9p.Group) bool { return false }
+
+func (userPool) Uid2User(uid int) go9p.User          { return user9p(strconv.Itoa(uid)) }
+func (userPool) Uname2User(uname string) go9p.User   { return user9p(uname) }
+func (userPool) Gid2Group(gid int) go9p.Group        { return nil }
+func (userPool) Gname2Group(gname string) go9p.Group { return nil }
@@ -0,0 +1,199 @@
+// Copyright 2018 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"upspin.io/log"
+	"upspin.io/upspin"
+)
+
+// blockCache is a cache on disk of the cleartext of the blocks read,
+// keyed by their location, so that files read again, even by a later
+// run of the server, need not be fetched again. The least recently used
+// blocks are dropped to keep the total size of the blocks within a
+// limit. The modification time of each file holding a block is the
+// time the block was last used, which orders the blocks on startup.
+//
+// Blocks are unpacked before being cached, so only readers that could
+// unpack a block themselves are served it from the cache.
+//
+// A nil *blockCache caches nothing.
+type blockCache struct {
+	dir string // directory holding a file for each block
+	max int64  // maximum total size of the blocks
+
+	mu     sync.Mutex // protects the fields below
+	size   int64      // total size of the blocks
+	lru    *list.List // of *cachedBlock, most recently used first
+	blocks map[string]*list.Element
+}
+
+type cachedBlock struct {
+	key  string
+	size int64
+}
+
+// newBlockCache returns a cache of at most max bytes of blocks in
+// cacheDir, holding the blocks cached there by earlier runs, or nil if
+// cacheDir is empty or max is not positive.
+func newBlockCache(cacheDir string, max int64) *blockCache {
+	if cacheDir == "" || max <= 0 {
+		return nil
+	}
+	c := &blockCache{
+		dir:    filepath.Join(cacheDir, "9upspinfs", "blocks"),
+		max:    max,
+		lru:    list.New(),
+		blocks: make(map[string]*list.Element),
+	}
+	if err := os.MkdirAll(c.dir, 0700); err != nil {
+		log.Error.Printf("9upspinfs: block cache: %v", err)
+		return nil
+	}
+	infos, err := ioutil.ReadDir(c.dir)
+	if err != nil {
+		log.Error.Printf("9upspinfs: block cache: %v", err)
+		return nil
+	}
+	// Oldest first, so that the most recently used end up in front.
+	sort.Slice(infos, func(i, j int) bool { return infos[i].ModTime().Before(infos[j].ModTime()) })
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, fi := range infos {
+		if fi.IsDir() {
+			continue
+		}
+		if strings.HasSuffix(fi.Name(), ".tmp") {
+			// Left by a run that died while writing it.
+			os.Remove(filepath.Join(c.dir, fi.Name()))
+			continue
+		}
+		c.add(fi.Name(), fi.Size())
+	}
+	return c
+}
+
+// blockKey returns the key of the block at loc.
+func blockKey(loc upspin.Location) string {
+	sum := sha256.Sum256([]byte(loc.Endpoint.String() + " " + string(loc.Reference)))
+	return hex.EncodeToString(sum[:])
+}
+
+// get returns the cleartext of the block with the given key, if cached.
+func (c *blockCache) get(key string) ([]byte, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mu.Lock()
+	e, ok := c.blocks[key]
+	if ok {
+		c.lru.MoveToFront(e)
+	}
+	c.mu.Unlock()
+	if !ok {
+		return nil, false
+	}
+	name := filepath.Join(c.dir, key)
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		// Dropped meanwhile, or lost.
+		c.drop(key)
+		return nil, false
+	}
+	now := time.Now()
+	os.Chtimes(name, now, now)
+	return data, true
+}
+
+// put caches the cleartext of the block with the given key.
+func (c *blockCache) put(key string, data []byte) {
+	if c == nil || int64(len(data)) > c.max {
+		return
+	}
+	c.mu.Lock()
+	_, ok := c.blocks[key]
+	c.mu.Unlock()
+	if ok {
+		return
+	}
+	// Written under a temporary name, so that no run of the server
+	// sees a partly written block.
+	name := filepath.Join(c.dir, key)
+	tmp, err := ioutil.TempFile(c.dir, key+".*.tmp")
+	if err != nil {
+		log.Debug.Printf("9upspinfs: block cache: %v", err)
+		return
+	}
+	_, err = tmp.Write(data)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), name)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		log.Debug.Printf("9upspinfs: block cache: %v", err)
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.blocks[key]; !ok {
+		c.add(key, int64(len(data)))
+	}
+}
+
+// add records the block with the given key as the most recently used,
+// dropping the least recently used blocks beyond the limit. c.mu must
+// be held.
+func (c *blockCache) add(key string, size int64) {
+	c.blocks[key] = c.lru.PushFront(&cachedBlock{key: key, size: size})
+	c.size += size
+	for c.size > c.max {
+		e := c.lru.Back()
+		b := e.Value.(*cachedBlock)
+		c.lru.Remove(e)
+		delete(c.blocks, b.key)
+		c.size -= b.size
+		os.Remove(filepath.Join(c.dir, b.key))
+	}
+}
+
+// drop forgets the block with the given key, if cached,
+// and removes its file.
+func (c *blockCache) drop(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.blocks[key]
+	if !ok {
+		return
+	}
+	b := e.Value.(*cachedBlock)
+	c.lru.Remove(e)
+	delete(c.blocks, key)
+	c.size -= b.size
+	os.Remove(filepath.Join(c.dir, key))
+}
+
+// stats returns the number of blocks cached and their total size.
+func (c *blockCache) stats() (n int, size int64) {
+	if c == nil {
+		return 0, 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lru.Len(), c.size
+}
@@ -0,0 +1,252 @@
+// Copyright 2018 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// This file implements the synthetic files at the root of the tree,
+// next to the user directories, through which a running server is
+// inspected and controlled: commands written to ctl are executed,
+// reading status reports the state of the server and reading errors
+// lists the files that could not be stored.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"upspin.io/errors"
+	"upspin.io/upspin"
+	"upspin.io/user"
+
+	go9p "github.com/lionkov/go9p/p"
+	"github.com/lionkov/go9p/p/srv"
+)
+
+// synthFile is a file served by 9upspinfs itself rather than stored in Upspin.
+type synthFile struct {
+	name string
+	mode uint32
+}
+
+var (
+	ctlFile    = &synthFile{name: "ctl", mode: 0200}
+	statusFile = &synthFile{name: "status", mode: 0400}
+	errorsFile = &synthFile{name: "errors", mode: 0400}
+)
+
+// synthFiles are the synthetic files at the root.
+var synthFiles = []*synthFile{ctlFile, statusFile, errorsFile}
+
+var errBadCtl = &go9p.Error{Err: "bad control message", Errornum: go9p.EINVAL}
+
+// lookupSynth returns the synthetic file at the root called name, or nil.
+// User names always contain an @, so they never collide with these.
+func lookupSynth(name string) *synthFile {
+	for _, s := range synthFiles {
+		if s.name == name {
+			return s
+		}
+	}
+	return nil
+}
+
+func (s *synthFile) qid() *go9p.Qid {
+	return &go9p.Qid{Path: qidpath(upspin.PathName("/" + s.name))}
+}
+
+// isAdmin reports whether id may use the synthetic files, which
+// affect the whole server. Only the server's own user may do so.
+func (f *upspinFS) isAdmin(id *identity) bool {
+	return id.cfg.UserName() == f.cfg.UserName()
+}
+
+// synthDir returns the directory entry of s as seen by id.
+func (f *upspinFS) synthDir(id *identity, s *synthFile) *go9p.Dir {
+	now := uint32(time.Now().Unix())
+	return &go9p.Dir{
+		Qid:   *s.qid(),
+		Mode:  s.mode,
+		Atime: now,
+		Mtime: now,
+		Name:  s.name,
+		Uid:   string(f.cfg.UserName()),
+		Gid:   string(id.cfg.UserName()),
+		Muid:  string(f.cfg.UserName()),
+	}
+}
+
+// openSynth opens the synthetic file of fid. The contents of status
+// and errors are produced when it is opened, so that they do not change while
+// being read.
+func (f *upspinFS) openSynth(fid *Fid, mode uint8) error {
+	if !f.isAdmin(fid.id) {
+		return srv.Eperm
+	}
+	switch fid.synth {
+	case ctlFile:
+		if mode&3 != go9p.OWRITE {
+			return srv.Eperm
+		}
+	case statusFile:
+		if mode&3 != go9p.OREAD {
+			return srv.Eperm
+		}
+		fid.synthData = f.status()
+	case errorsFile:
+		if mode&3 != go9p.OREAD {
+			return srv.Eperm
+		}
+		fid.synthData = f.errlog.contents()
+	}
+	return nil
+}
+
+// readSynth reads the synthetic file of fid at offset off.
+func (f *upspinFS) readSynth(fid *Fid, b []byte, off int64) (int, error) {
+	if fid.synth == ctlFile {
+		return 0, srv.Eperm
+	}
+	return readData(fid.synthData, b, off), nil
+}
+
+// readData reads data at offset off into b.
+func readData(data, b []byte, off int64) int {
+	if off >= int64(len(data)) {
+		return 0
+	}
+	return copy(b, data[off:])
+}
+
+// writeSynth writes to the synthetic file of fid. Each line written
+// to ctl is a command.
+func (f *upspinFS) writeSynth(fid *Fid, b []byte) (int, error) {
+	if fid.synth != ctlFile {
+		return 0, srv.Eperm
+	}
+	for _, line := range strings.Split(string(b), "\n") {
+		args := strings.Fields(line)
+		if len(args) == 0 {
+			continue
+		}
+		if err := f.ctl(args); err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
+
+type ctlCmd struct {
+	nargs int // number of arguments after the command name, or -1 if it varies
+	fn    func(f *upspinFS, args []string) error
+}
+
+// ctlCmds are the commands accepted by the ctl file.
+var ctlCmds = map[string]ctlCmd{
+	"flush":    {0, (*upspinFS).ctlFlush},
+	"sync":     {1, (*upspinFS).ctlSync},
+	"drop":     {1, (*upspinFS).ctlDrop},
+	"debug":    {1, (*upspinFS).ctlDebug},
+	"snapshot": {0, (*upspinFS).ctlSnapshot},
+	"share":    {-1, (*upspinFS).ctlShare},
+}
+
+// ctl executes the command args read from the ctl file.
+func (f *upspinFS) ctl(args []string) error {
+	cmd, ok := ctlCmds[args[0]]
+	if !ok || cmd.nargs >= 0 && len(args)-1 != cmd.nargs {
+		return errBadCtl
+	}
+	return cmd.fn(f, args[1:])
+}
+
+// ctlFlush stores the contents of every file being written.
+func (f *upspinFS) ctlFlush(args []string) error {
+	var firstErr error
+	for _, id := range f.identities() {
+		for _, file := range id.fileCache.files() {
+			if err := file.flush(); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return firstErr
+}
+
+// ctlSync stores the contents of the file args[0] if it is being written.
+func (f *upspinFS) ctlSync(args []string) error {
+	const op errors.Op = "9upspinfs.sync"
+	name := upspin.PathName(args[0])
+	found := false
+	for _, id := range f.identities() {
+		for _, file := range id.fileCache.files() {
+			if file.Name() != name {
+				continue
+			}
+			found = true
+			if err := file.flush(); err != nil {
+				return err
+			}
+		}
+	}
+	if !found {
+		return errors.E(op, name, errors.NotExist, "not being written")
+	}
+	return nil
+}
+
+// ctlDrop forgets the identity of the user args[0], so that its config
+// is read again on its next attach. Fids attached earlier keep working.
+func (f *upspinFS) ctlDrop(args []string) error {
+	const op errors.Op = "9upspinfs.drop"
+	u, err := user.Clean(upspin.UserName(args[0]))
+	if err != nil {
+		return errors.E(op, errors.Invalid, err)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.ids[u]; !ok {
+		return errors.E(op, u, errors.NotExist, "no identity")
+	}
+	delete(f.ids, u)
+	return nil
+}
+
+// ctlDebug sets the 9P debug level.
+func (f *upspinFS) ctlDebug(args []string) error {
+	level, err := strconv.Atoi(args[0])
+	if err != nil {
+		return errBadCtl
+	}
+	f.Debuglevel = level
+	return nil
+}
+
+// status returns the contents of the status file: the number of open
+// fids, and for each identity its endpoints, the sizes of its caches
+// and the files it is writing.
+func (f *upspinFS) status() []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "open %d\n", atomic.LoadInt64(&f.nopen))
+	if f.blocks != nil {
+		n, size := f.blocks.stats()
+		fmt.Fprintf(&b, "blocks %d %d\n", n, size)
+	}
+	for _, id := range f.identities() {
+		u := id.cfg.UserName()
+		fmt.Fprintf(&b, "user %s dir %s store %s\n", u, id.cfg.DirEndpoint(), id.cfg.StoreEndpoint())
+		which, parsed := id.accessCache.size()
+		entries, dirs := id.client.size()
+		fmt.Fprintf(&b, "cache %s access %d %d dir %d %d\n", u, which, parsed, entries, dirs)
+		files := id.fileCache.files()
+		sort.Slice(files, func(i, j int) bool { return files[i].Name() < files[j].Name() })
+		for _, file := range files {
+			fmt.Fprintf(&b, "pending %s %d\n", file.Name(), file.length())
+		}
+	}
+	return b.Bytes()
+}
@@ -0,0 +1,372 @@
+// Copyright 2018 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"upspin.io/log"
+	"upspin.io/path"
+	"upspin.io/upspin"
+)
+
+// dirCacheTTL is how long a cached directory entry is trusted when the
+// directory server cannot tell us about changes through Watch.
+const dirCacheTTL = 5 * time.Second
+
+// watchRetry is how long to wait before watching a tree again
+// after Watch failed.
+const watchRetry = time.Minute
+
+// maxCachedEntries bounds the number of entries and directory
+// listings remembered; the cache is emptied when it is exceeded.
+const maxCachedEntries = 10000
+
+// cachingClient is an upspin.Client that remembers the results of Lookup,
+// without following a final link, and of listing directories with Glob.
+// Results reached through a link are not remembered, since the events
+// of Watch name the entries the links lead to.
+//
+// The tree of each user is watched with DirServer.Watch and cached
+// entries are updated or dropped as the events arrive, so that they stay
+// valid indefinitely. If the tree cannot be watched the entries expire
+// after dirCacheTTL. Changes made through the client itself are seen
+// immediately.
+type cachingClient struct {
+	upspin.Client
+
+	mu      sync.Mutex // protects the fields below
+	gen     uint64     // incremented whenever entries are dropped
+	entries map[upspin.PathName]cachedEntry
+	dirs    map[upspin.PathName]cachedDir
+	watches map[upspin.UserName]*watchState
+}
+
+var _ upspin.Client = (*cachingClient)(nil)
+
+type cachedEntry struct {
+	entry   *upspin.DirEntry
+	expires time.Time
+}
+
+type cachedDir struct {
+	entries []*upspin.DirEntry
+	expires time.Time
+}
+
+type watchState struct {
+	active bool      // events are being received
+	retry  time.Time // when to try watching again if not active
+}
+
+func newCachingClient(c upspin.Client) *cachingClient {
+	return &cachingClient{
+		Client:  c,
+		entries: make(map[upspin.PathName]cachedEntry),
+		dirs:    make(map[upspin.PathName]cachedDir),
+		watches: make(map[upspin.UserName]*watchState),
+	}
+}
+
+// Lookup implements upspin.Client.
+func (c *cachingClient) Lookup(name upspin.PathName, followFinal bool) (*upspin.DirEntry, error) {
+	p, err := path.Parse(name)
+	if followFinal || err != nil {
+		return c.Client.Lookup(name, followFinal)
+	}
+	name = p.Path()
+	c.mu.Lock()
+	ce, ok := c.entries[name]
+	if ok && c.fresh(p.User(), ce.expires) {
+		c.mu.Unlock()
+		return ce.entry, nil
+	}
+	gen := c.gen
+	c.mu.Unlock()
+
+	entry, err := c.Client.Lookup(name, false)
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	if c.gen == gen && entry.Name == name {
+		c.limit()
+		c.entries[name] = cachedEntry{entry: entry, expires: time.Now().Add(dirCacheTTL)}
+	}
+	c.mu.Unlock()
+	return entry, nil
+}
+
+// Glob implements upspin.Client. Only patterns listing
+// a whole directory, dir/*, are cached.
+func (c *cachingClient) Glob(pattern string) ([]*upspin.DirEntry, error) {
+	dir := strings.TrimSuffix(pattern, "/*")
+	if dir == pattern || strings.ContainsAny(dir, `*?[\`) {
+		return c.Client.Glob(pattern)
+	}
+	p, err := path.Parse(upspin.PathName(dir))
+	if err != nil {
+		return c.Client.Glob(pattern)
+	}
+	name := p.Path()
+	c.mu.Lock()
+	cd, ok := c.dirs[name]
+	if ok && c.fresh(p.User(), cd.expires) {
+		c.mu.Unlock()
+		return cd.entries, nil
+	}
+	gen := c.gen
+	c.mu.Unlock()
+
+	entries, err := c.Client.Glob(pattern)
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	if c.gen == gen && listed(name, entries) {
+		c.limit()
+		c.dirs[name] = cachedDir{entries: entries, expires: time.Now().Add(dirCacheTTL)}
+	}
+	c.mu.Unlock()
+	return entries, nil
+}
+
+// listed reports whether entries, the listing of dir, are named as
+// entries of dir, rather than of a directory a link in dir leads to.
+// An empty listing does not tell, so it is reported as not listed.
+func listed(dir upspin.PathName, entries []*upspin.DirEntry) bool {
+	for _, e := range entries {
+		if path.DropPath(e.Name, 1) != dir {
+			return false
+		}
+	}
+	return len(entries) > 0
+}
+
+// fresh reports whether an entry of user u's tree expiring at
+// expires is still valid, and starts watching the tree if needed.
+// c.mu must be held.
+func (c *cachingClient) fresh(u upspin.UserName, expires time.Time) bool {
+	w, ok := c.watches[u]
+	if !ok || !w.active && time.Now().After(w.retry) {
+		if !ok {
+			w = new(watchState)
+			c.watches[u] = w
+		}
+		w.retry = time.Now().Add(watchRetry)
+		go c.watch(u)
+	}
+	return w.active || time.Now().Before(expires)
+}
+
+// limit empties the cache if it is too big. c.mu must be held.
+func (c *cachingClient) limit() {
+	if len(c.entries)+len(c.dirs) >= maxCachedEntries {
+		c.entries = make(map[upspin.PathName]cachedEntry)
+		c.dirs = make(map[upspin.PathName]cachedDir)
+	}
+}
+
+// watch follows the changes to the tree of user u until Watch fails.
+func (c *cachingClient) watch(u upspin.UserName) {
+	root := upspin.PathName(u + "/")
+	ds, err := c.Client.DirServer(root)
+	if err != nil {
+		log.Debug.Printf("9upspinfs: cannot watch %s: %v", root, err)
+		return
+	}
+	done := make(chan struct{})
+	defer close(done)
+	events, err := ds.Watch(root, upspin.WatchNew, done)
+	if err != nil {
+		log.Debug.Printf("9upspinfs: cannot watch %s: %v", root, err)
+		return
+	}
+
+	// Entries cached so far may have changed before the watch started.
+	c.mu.Lock()
+	c.watches[u].active = true
+	c.dropUser(u)
+	c.mu.Unlock()
+
+	for e := range events {
+		if e.Error != nil {
+			log.Debug.Printf("9upspinfs: watching %s: %v", root, e.Error)
+			break
+		}
+		c.update(e)
+	}
+
+	c.mu.Lock()
+	c.watches[u].active = false
+	c.watches[u].retry = time.Now().Add(watchRetry)
+	c.mu.Unlock()
+}
+
+// update applies the change reported by the Watch event e.
+func (c *cachingClient) update(e upspin.Event) {
+	if e.Entry == nil {
+		return
+	}
+	p, err := path.Parse(e.Entry.Name)
+	if err != nil {
+		return
+	}
+	name := p.Path()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.gen++
+	delete(c.dirs, p.Drop(1).Path())
+	if e.Delete {
+		delete(c.entries, name)
+		delete(c.dirs, name)
+		return
+	}
+	if _, ok := c.entries[name]; ok {
+		// A copy, so that the entry of the event is not shared.
+		entry := *e.Entry
+		c.entries[name] = cachedEntry{entry: &entry, expires: time.Now().Add(dirCacheTTL)}
+	}
+}
+
+// dropUser drops the cached entries of user u's tree. c.mu must be held.
+func (c *cachingClient) dropUser(u upspin.UserName) {
+	c.gen++
+	prefix := upspin.PathName(u + "/")
+	for name := range c.entries {
+		if strings.HasPrefix(string(name), string(prefix)) {
+			delete(c.entries, name)
+		}
+	}
+	for name := range c.dirs {
+		if strings.HasPrefix(string(name), string(prefix)) {
+			delete(c.dirs, name)
+		}
+	}
+}
+
+// invalidate drops the cached entry of name, the listing of
+// name if it is a directory, and the listing of its parent.
+func (c *cachingClient) invalidate(name upspin.PathName) {
+	p, err := path.Parse(name)
+	if err != nil {
+		return
+	}
+	name = p.Path()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.gen++
+	delete(c.entries, name)
+	delete(c.dirs, name)
+	delete(c.dirs, p.Drop(1).Path())
+}
+
+// invalidateTree is like invalidate but also drops
+// everything cached below name.
+func (c *cachingClient) invalidateTree(name upspin.PathName) {
+	c.invalidate(name)
+	p, err := path.Parse(name)
+	if err != nil {
+		return
+	}
+	prefix := string(p.Path()) + "/"
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for name := range c.entries {
+		if strings.HasPrefix(string(name), prefix) {
+			delete(c.entries, name)
+		}
+	}
+	for name := range c.dirs {
+		if strings.HasPrefix(string(name), prefix) {
+			delete(c.dirs, name)
+		}
+	}
+}
+
+// size returns the number of cached entries and directory listings.
+func (c *cachingClient) size() (entries, dirs int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.entries), len(c.dirs)
+}
+
+// The methods below change the tree and drop the affected entries.
+
+// Put implements upspin.Client.
+func (c *cachingClient) Put(name upspin.PathName, data []byte) (*upspin.DirEntry, error) {
+	defer c.invalidate(name)
+	return c.Client.Put(name, data)
+}
+
+// PutSequenced implements upspin.Client.
+func (c *cachingClient) PutSequenced(name upspin.PathName, seq int64, data []byte) (*upspin.DirEntry, error) {
+	defer c.invalidate(name)
+	return c.Client.PutSequenced(name, seq, data)
+}
+
+// MakeDirectory implements upspin.Client.
+func (c *cachingClient) MakeDirectory(dirName upspin.PathName) (*upspin.DirEntry, error) {
+	defer c.invalidate(dirName)
+	return c.Client.MakeDirectory(dirName)
+}
+
+// Rename implements upspin.Client.
+func (c *cachingClient) Rename(oldName, newName upspin.PathName) (*upspin.DirEntry, error) {
+	defer c.invalidateTree(newName)
+	defer c.invalidateTree(oldName)
+	return c.Client.Rename(oldName, newName)
+}
+
+// Delete implements upspin.Client.
+func (c *cachingClient) Delete(name upspin.PathName) error {
+	defer c.invalidate(name)
+	return c.Client.Delete(name)
+}
+
+// PutLink implements upspin.Client.
+func (c *cachingClient) PutLink(oldName, linkName upspin.PathName) (*upspin.DirEntry, error) {
+	defer c.invalidate(linkName)
+	return c.Client.PutLink(oldName, linkName)
+}
+
+// PutDuplicate implements upspin.Client.
+func (c *cachingClient) PutDuplicate(oldName, newName upspin.PathName) (*upspin.DirEntry, error) {
+	defer c.invalidate(newName)
+	return c.Client.PutDuplicate(oldName, newName)
+}
+
+// SetTime implements upspin.Client.
+func (c *cachingClient) SetTime(name upspin.PathName, t upspin.Time) error {
+	defer c.invalidate(name)
+	return c.Client.SetTime(name, t)
+}
+
+// DirServer implements upspin.Client. Entries put or deleted through
+// the returned DirServer are dropped from the cache.
+func (c *cachingClient) DirServer(name upspin.PathName) (upspin.DirServer, error) {
+	ds, err := c.Client.DirServer(name)
+	if err != nil {
+		return nil, err
+	}
+	return &cachingDirServer{DirServer: ds, c: c}, nil
+}
+
+type cachingDirServer struct {
+	upspin.DirServer
+	c *cachingClient
+}
+
+func (d *cachingDirServer) Put(entry *upspin.DirEntry) (*upspin.DirEntry, error) {
+	defer d.c.invalidate(entry.Name)
+	return d.DirServer.Put(entry)
+}
+
+func (d *cachingDirServer) Delete(name upspin.PathName) (*upspin.DirEntry, error) {
+	defer d.c.invalidate(name)
+	return d.DirServer.Delete(name)
+}
@@ -16,6 +16,74 @@ Usage:
 	By default, 9upspinfs starts the 9P file server as the Plan 9
 	service named "upspin".
 
+	Both 9P2000 and the 9P2000.L dialect used by the Linux v9fs
+	client are served; the dialect is chosen by the client's Tversion.
+
+	Upspin links are served as symbolic links in 9P2000.u and
+	9P2000.L, with targets relative to the directory holding the
+	link, and symbolic links created by clients become Upspin links.
+
+	Through 9P2000.L, the metadata of each entry can be read as
+	extended attributes in the user.upspin namespace: packing,
+	sequence, signedname, writer, link, and for files blocks, the
+	number of blocks, refs, a line with the offset, size, store
+	endpoint and reference of each block, and packdata, in hex.
+	For example, getfattr -d -m user.upspin /mnt/upspin/ann@example.com/f.
+
+	The same information, with the readers allowed by the Access
+	file, is read by any client from the read-only tree .info at
+	the root, which mirrors the Upspin tree: reading a file such
+	as .info/ann@example.com/f describes ann@example.com/f as
+	upspin info does.
+
+	Every directory holds a read-only file Access.effective naming
+	the Access file that governs the directory, the rights it grants
+	to each user and group it names, and the rights of each user once
+	groups are expanded. Access and Group files are parsed as they are
+	written, and a write making them malformed fails.
+
+	A file written is stored in Upspin when a fid open on it for
+	writing is clunked, and the clunk waits for it to be stored. If
+	it cannot be, the clunk fails with the error, which is also
+	recorded in the control file errors described below. A file
+	changed in Upspin since it was opened is not overwritten: what
+	was written is stored instead, then and by every later store, in
+	the new file <name>.conflict-<writer>-<time> next to it, and the
+	clunk fails.
+	A file is also stored, and kept open for further writes, by
+	Tfsync in 9P2000.L and by a 9P2000 wstat touching no field,
+	which likewise fail if it cannot be. Until then, the contents
+	of the files being written are journaled in the cache directory,
+	and those left by a server that died, or that could not be stored,
+	are stored, as reported in the log, when the next server using
+	the directory starts, unless it is read-only or they were to be
+	removed once closed. The cache directory must therefore not be
+	shared by running servers.
+
+	The blocks of the files read are kept, unpacked, in the cache
+	directory, so that reading them again, even after a restart,
+	fetches nothing. The least recently used blocks are dropped to
+	keep them within the size given by -cachesize.
+
+	Exclusive-use (DMEXCL) and append-only (DMAPPEND) files and
+	the byte-range locks of 9P2000.L are kept by the server, so
+	they bind only its own clients and are forgotten when it exits.
+	Writes to append-only files, and through 9P2000.L files opened
+	with O_APPEND, go to the end of the file whatever their offset.
+
+	The root of the tree of each user without a suffix holds a
+	read-only directory .snapshot, through which the dated snapshots
+	of the tree, kept in the tree of the user's snapshot user
+	user+snapshot@domain, are browsed.
+
+	With -readonly, every request that would change the tree fails
+	with a permission error and files are opened for reading only.
+	Like the other flags, it may also be set in the config file:
+
+		cmdflags:
+		  9upspinfs:
+		    readonly: true
+
 The flags are:
 
   -9paddr string
@@ -24,6 +92,8 @@ The flags are:
     	network name for listen address (default "service")
   -addr host:port
     	publicly accessible network address (host:port)
+  -allow users
+    	comma-separated list of Upspin users allowed to attach; if set, clients must authenticate
   -cachedir directory
     	directory containing all file caches (default "$HOME/upspin")
   -cachesize int
@@ -32,6 +102,8 @@ The flags are:
     	user's configuration file (default "$HOME/upspin/config")
   -debug int
     	9P debug level
+  -exports file
+    	file holding a table of the exports an attach may name
   -http address
     	address for incoming insecure network connections (default ":80")
   -https address
@@ -44,15 +116,89 @@ The flags are:
     	level of logging: debug, info, error, disabled (default info)
   -prudent
     	protect against malicious directory server
+  -readonly
+    	serve the tree read-only, rejecting every change
   -tls_cert file
     	TLS Certificate file in PEM format
   -tls_key file
     	TLS Key file in PEM format
+  -usersdir directory
+    	directory holding <user>/config for each user an attach may act as
   -version
     	print build version and exit
   -writethrough
     	make storage cache writethrough
 
+Authentication:
+
+If the -allow flag is set, clients must authenticate with Tauth as one of
+the listed Upspin users before attaching. Reading the auth fid yields the
+challenge line
+
+	upspin-sig1 <server user> <nonce>
+
+and the client writes back "<R> <S>\n", the hexadecimal components of the
+signature, made with the user's Upspin key, of the SHA-256 hash of the user
+name, a newline, and the challenge line. When the client attaches, with the
+user name as uname, the signature is checked against the key registered in
+the key server. Without -allow, no authentication is required and any
+client may attach.
+
+Multiple users:
+
+By default every client acts as the user of the server's config. If the
+-usersdir flag names a directory, such as $HOME/upspin/users, the uname
+of each attach selects the config <directory>/<uname>/config and the
+client acts as that Upspin user, with its own keys. Since the uname must
+then be trusted, -usersdir requires -allow.
+
+Exports:
+
+The aname of an attach selects the tree the client sees. An empty aname
+gives the root holding the directory of every user. Otherwise the aname
+names an export in the table read from the file given by -exports, or is
+an Upspin path such as ann@example.com/proj, whose tree is served as is.
+If there is a table, only the exports it names may be attached to, so
+that the trees of its exports cannot be reached without their options.
+Each line of the table names an export, its root and its options:
+
+	name path [readonly] [allow=user,...] [packing=name]
+
+Clients of a readonly export cannot change it. The users of allow,
+instead of those given by -allow, are the only ones that may attach, after
+authenticating. Files written through an export with a packing, such as
+plain or eeintegrity, are packed with it instead of the user's packing.
+Blank lines and lines starting with # are ignored. For example:
+
+	proj ann@example.com/proj readonly allow=bob@example.com
+
+	mount -t 9p -o trans=tcp,port=7777,aname=proj,version=9p2000.L host /mnt/proj
+
+Control files:
+
+Next to the user directories, the root holds three files usable only by
+the user of the server's config. Reading status reports the number of
+open fids, the number and total size of the blocks cached and, for each
+user being served, its directory and store endpoints, the sizes of its
+caches and the files it is writing. Reading errors lists the files that
+could not be stored, with the time, the user and the error. The list is
+kept in the cache directory, so that it survives a restart, or else in
+memory. Each line written to ctl is one of the commands
+
+	flush		store every file being written
+	sync path	store the file path, which is being written
+	drop user	forget user's config, rereading it on the next attach
+	debug level	set the 9P debug level
+	snapshot	take a snapshot of the tree of the server's user
+	share add rights users path
+			grant rights to users in the Access file governing
+			path, creating one if there is none, and share fix path
+	share fix path	rewrap the keys of the files in path for their readers
+
+For example:
+
+	echo flush > /mnt/upspin/ctl
+
 Examples:
 
 To listen on TCP:
@@ -63,7 +209,7 @@ If you have Plan9Port (https://9fans.github.io/plan9port/):
 
 	9upspinfs &	# posts service to p9p namespace directory
 	# mount using v9fs
-	mount -t 9p $(namespace)/acme /mnt/upspin -o trans=unix,uname=$USER
+	mount -t 9p $(namespace)/upspin /mnt/upspin -o trans=unix,uname=$USER,version=9p2000.L
 	# or mount using fuse
 	9pfuse $(namespace)/upspin /mnt/upspin
 
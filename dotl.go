@@ -0,0 +1,1085 @@
+// Copyright 2018 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// This file implements the 9P2000.L dialect spoken by the Linux v9fs
+// client. Go9p only knows 9P2000 and 9P2000.u, so connections that ask
+// for 9P2000.L in their Tversion are served here instead, using the same
+// file system operations as the go9p handlers in fs.go.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"upspin.io/errors"
+	"upspin.io/log"
+	"upspin.io/upspin"
+
+	go9p "github.com/lionkov/go9p/p"
+	"github.com/lionkov/go9p/p/srv"
+)
+
+// Message types added by 9P2000.L. Messages shared with 9P2000
+// use the go9p constants. Each reply type is the request type plus one.
+const (
+	Tlerror      = 6
+	Tstatfs      = 8
+	Tlopen       = 12
+	Tlcreate     = 14
+	Tsymlink     = 16
+	Tmknod       = 18
+	Trename      = 20
+	Treadlink    = 22
+	Tgetattr     = 24
+	Tsetattr     = 26
+	Txattrwalk   = 30
+	Txattrcreate = 32
+	Treaddir     = 40
+	Tfsync       = 50
+	Tlock        = 52
+	Tgetlock     = 54
+	Tlink        = 70
+	Tmkdir       = 72
+	Trenameat    = 74
+	Tunlinkat    = 76
+)
+
+// Rlerror is the error reply of 9P2000.L; Rerror is not used.
+const Rlerror = Tlerror + 1
+
+const dotlVersion = "9P2000.L"
+
+// dotlMsize is the largest message size we agree to.
+const dotlMsize = 128*1024 + go9p.IOHDRSZ
+
+// dotlMinMsize is the smallest message size we agree to, which leaves
+// room for some data after the header of a read or write.
+const dotlMinMsize = 512 + go9p.IOHDRSZ
+
+// Linux error numbers returned in Rlerror.
+const (
+	ePERM     = 1
+	eNOENT    = 2
+	eIO       = 5
+	eBADF     = 9
+	eBUSY     = 16
+	eACCES    = 13
+	eEXIST    = 17
+	eNOTDIR   = 20
+	eISDIR    = 21
+	eINVAL    = 22
+	eROFS     = 30
+	eNOSYS    = 38
+	eNOTEMPTY = 39
+	eNODATA   = 61
+	eNOTSUP   = 95
+)
+
+// Linux open flags used by Tlopen and Tlcreate.
+const (
+	lO_ACCMODE = 03
+	lO_TRUNC   = 01000
+	lO_APPEND  = 02000
+)
+
+// Linux file mode bits and directory entry types.
+const (
+	sIFMT  = 0170000
+	sIFDIR = 0040000
+	sIFREG = 0100000
+	sIFLNK = 0120000
+
+	dtDIR = 4
+	dtREG = 8
+	dtLNK = 10
+)
+
+// Bits of the Tgetattr request mask and Rgetattr valid mask.
+const getattrBasic = 0x000007ff
+
+// Bits of the Tsetattr valid mask.
+const (
+	setattrMode     = 0x00000001
+	setattrSize     = 0x00000008
+	setattrMTime    = 0x00000020
+	setattrMTimeSet = 0x00000100
+)
+
+// nobodyGID is the gid reported for every file, whose group bits
+// are those of all users.
+const nobodyGID = 65534
+
+// v9fsMagic is the file system type reported by Rstatfs.
+const v9fsMagic = 0x01021997
+
+var (
+	errBadMsg  = &go9p.Error{Err: "malformed message", Errornum: eINVAL}
+	errBadFid  = &go9p.Error{Err: "unknown fid", Errornum: eBADF}
+	errFidUsed = &go9p.Error{Err: "fid already in use", Errornum: eBADF}
+	errNotOpen = &go9p.Error{Err: "fid not open", Errornum: eBADF}
+	errIsOpen  = &go9p.Error{Err: "fid already opened", Errornum: eBADF}
+	errIsDir   = &go9p.Error{Err: "is a directory", Errornum: eISDIR}
+	errNotDir  = &go9p.Error{Err: "not a directory", Errornum: eNOTDIR}
+	errNoSys   = &go9p.Error{Err: "function not implemented", Errornum: eNOSYS}
+	errNotSup  = &go9p.Error{Err: "operation not supported", Errornum: eNOTSUP}
+	errMsize   = &go9p.Error{Err: "msize too small", Errornum: go9p.EINVAL}
+)
+
+// listen accepts connections on the network address and serves each
+// of them in the dialect requested by its first Tversion.
+func (f *upspinFS) listen(ntype, addr string) error {
+	l, err := net.Listen(ntype, addr)
+	if err != nil {
+		return err
+	}
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go f.serveConn(c)
+	}
+}
+
+// serveConn serves a single connection. 9P2000.L is handled by dotlConn;
+// anything else is passed on to go9p together with the message already read.
+func (f *upspinFS) serveConn(c net.Conn) {
+	msg, err := readMsg(c, dotlMsize)
+	if err != nil {
+		c.Close()
+		return
+	}
+	if msg[4] == go9p.Tversion {
+		d := &ldec{b: msg[7:]}
+		d.u32() // msize
+		if strings.HasPrefix(d.str(), dotlVersion) && d.err == nil {
+			newDotlConn(f, c).serve(msg)
+			return
+		}
+	}
+	f.NewConn(&prefixConn{Conn: c, r: io.MultiReader(bytes.NewReader(msg), c)})
+}
+
+// prefixConn is a net.Conn whose first bytes have already been read.
+type prefixConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *prefixConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// readMsg reads a whole 9P message, including its size field.
+func readMsg(r io.Reader, msize uint32) ([]byte, error) {
+	var size [4]byte
+	if _, err := io.ReadFull(r, size[:]); err != nil {
+		return nil, err
+	}
+	n := binary.LittleEndian.Uint32(size[:])
+	if n < 7 || n > msize {
+		return nil, errBadMsg
+	}
+	msg := make([]byte, n)
+	copy(msg, size[:])
+	if _, err := io.ReadFull(r, msg[4:]); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// dotlConn is a connection speaking 9P2000.L.
+type dotlConn struct {
+	fs   *upspinFS
+	conn net.Conn
+
+	wmu sync.Mutex // serializes writes to conn
+
+	mu    sync.Mutex // protects the fields below
+	msize uint32
+	fids  map[uint32]*dotlFid
+	reqs  map[uint16]chan struct{} // closed when the request is answered
+}
+
+// dotlFid is a fid of a 9P2000.L connection.
+type dotlFid struct {
+	*Fid
+	open  bool
+	auth  *authState // set for authentication fids
+	xattr []byte     // value read through extended attribute fids; never nil for them
+}
+
+func newDotlConn(f *upspinFS, c net.Conn) *dotlConn {
+	return &dotlConn{
+		fs:    f,
+		conn:  c,
+		msize: dotlMsize,
+		fids:  make(map[uint32]*dotlFid),
+		reqs:  make(map[uint16]chan struct{}),
+	}
+}
+
+// serve handles the requests on the connection, starting with msg,
+// until the connection fails.
+func (c *dotlConn) serve(msg []byte) {
+	defer c.close()
+	for {
+		typ := msg[4]
+		tag := binary.LittleEndian.Uint16(msg[5:])
+		body := msg[7:]
+		if c.fs.Debuglevel > 0 {
+			log.Printf("9P2000.L <- type %d tag %d size %d", typ, tag, len(msg))
+		}
+		switch typ {
+		case go9p.Tversion:
+			c.version(tag, body)
+		case go9p.Tflush:
+			go c.flush(tag, body)
+		default:
+			done := make(chan struct{})
+			c.mu.Lock()
+			c.reqs[tag] = done
+			c.mu.Unlock()
+			go c.handle(tag, typ, body, done)
+		}
+		var err error
+		msg, err = readMsg(c.conn, c.maxMsize())
+		if err != nil {
+			return
+		}
+	}
+}
+
+// close clunks all remaining fids, releases the locks
+// held by its clients and closes the connection.
+func (c *dotlConn) close() {
+	c.conn.Close()
+	c.fs.locks.release(c)
+	c.mu.Lock()
+	fids := c.fids
+	c.fids = make(map[uint32]*dotlFid)
+	c.mu.Unlock()
+	for _, fid := range fids {
+		c.fs.clunk(fid.Fid)
+	}
+}
+
+func (c *dotlConn) maxMsize() uint32 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.msize
+}
+
+func (c *dotlConn) version(tag uint16, body []byte) {
+	d := &ldec{b: body}
+	msize := d.u32()
+	version := d.str()
+	if d.err != nil {
+		c.rerror(tag, d.err)
+		return
+	}
+	if msize < dotlMinMsize {
+		c.rerror(tag, errMsize)
+		return
+	}
+	if msize > dotlMsize {
+		msize = dotlMsize
+	}
+	if !strings.HasPrefix(version, dotlVersion) {
+		version = "unknown"
+	}
+	c.mu.Lock()
+	c.msize = msize
+	fids := c.fids
+	c.fids = make(map[uint32]*dotlFid)
+	c.mu.Unlock()
+	for _, fid := range fids {
+		c.fs.clunk(fid.Fid)
+	}
+	var r lenc
+	r.u32(msize)
+	r.str(version)
+	c.respond(tag, go9p.Rversion, r)
+}
+
+// flush waits for the flushed request to be answered before
+// answering the Tflush, as required by the protocol.
+func (c *dotlConn) flush(tag uint16, body []byte) {
+	d := &ldec{b: body}
+	oldtag := d.u16()
+	c.mu.Lock()
+	done := c.reqs[oldtag]
+	c.mu.Unlock()
+	if done != nil {
+		<-done
+	}
+	c.respond(tag, go9p.Rflush, nil)
+}
+
+type dotlHandler func(c *dotlConn, d *ldec, r *lenc) error
+
+var dotlHandlers = map[uint8]dotlHandler{
+	go9p.Tauth:   (*dotlConn).auth,
+	go9p.Tattach: (*dotlConn).attach,
+	go9p.Twalk:   (*dotlConn).walk,
+	go9p.Tread:   (*dotlConn).read,
+	go9p.Twrite:  (*dotlConn).write,
+	go9p.Tclunk:  (*dotlConn).clunk,
+	go9p.Tremove: (*dotlConn).remove,
+	Tstatfs:      (*dotlConn).statfs,
+	Tlopen:       (*dotlConn).lopen,
+	Tlcreate:     (*dotlConn).lcreate,
+	Tsymlink:     (*dotlConn).symlink,
+	Treadlink:    (*dotlConn).readlink,
+	Tgetattr:     (*dotlConn).getattr,
+	Tsetattr:     (*dotlConn).setattr,
+	Treaddir:     (*dotlConn).readdir,
+	Tfsync:       (*dotlConn).fsync,
+	Txattrwalk:   (*dotlConn).xattrwalk,
+	Txattrcreate: (*dotlConn).xattrcreate,
+	Tlock:        (*dotlConn).lock,
+	Tgetlock:     (*dotlConn).getlock,
+	Tmkdir:       (*dotlConn).mkdir,
+	Trenameat:    (*dotlConn).renameat,
+	Tunlinkat:    (*dotlConn).unlinkat,
+}
+
+func (c *dotlConn) handle(tag uint16, typ uint8, body []byte, done chan struct{}) {
+	defer func() {
+		c.mu.Lock()
+		if c.reqs[tag] == done {
+			delete(c.reqs, tag)
+		}
+		c.mu.Unlock()
+		close(done)
+	}()
+	h, ok := dotlHandlers[typ]
+	if !ok {
+		c.rerror(tag, errNoSys)
+		return
+	}
+	var r lenc
+	if err := h(c, &ldec{b: body}, &r); err != nil {
+		c.rerror(tag, err)
+		return
+	}
+	c.respond(tag, typ+1, r)
+}
+
+func (c *dotlConn) respond(tag uint16, typ uint8, body []byte) {
+	if c.fs.Debuglevel > 0 {
+		log.Printf("9P2000.L -> type %d tag %d size %d", typ, tag, 7+len(body))
+	}
+	var hdr lenc
+	hdr.u32(uint32(7 + len(body)))
+	hdr.u8(typ)
+	hdr.u16(tag)
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	c.conn.Write(append(hdr, body...))
+}
+
+func (c *dotlConn) rerror(tag uint16, err error) {
+	var r lenc
+	r.u32(errno(err))
+	c.respond(tag, Rlerror, r)
+}
+
+// errno maps an error to the Linux error number reported in Rlerror.
+func errno(err error) uint32 {
+	if e, ok := err.(*go9p.Error); ok {
+		return e.Errornum
+	}
+	switch {
+	case errors.Is(errors.NotExist, err):
+		return eNOENT
+	case errors.Is(errors.Exist, err):
+		return eEXIST
+	case errors.Is(errors.Permission, err), errors.Is(errors.Private, err):
+		return eACCES
+	case errors.Is(errors.IsDir, err):
+		return eISDIR
+	case errors.Is(errors.NotDir, err):
+		return eNOTDIR
+	case errors.Is(errors.NotEmpty, err):
+		return eNOTEMPTY
+	case errors.Is(errors.Invalid, err):
+		return eINVAL
+	}
+	return eIO
+}
+
+// fid returns the fid numbered n, which must not be an authentication
+// or extended attribute fid.
+func (c *dotlConn) fid(n uint32) (*dotlFid, error) {
+	fid, err := c.lookup(n)
+	if err != nil {
+		return nil, err
+	}
+	if fid.auth != nil || fid.xattr != nil {
+		return nil, srv.Ebaduse
+	}
+	return fid, nil
+}
+
+// lookup returns the fid numbered n.
+func (c *dotlConn) lookup(n uint32) (*dotlFid, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	fid, ok := c.fids[n]
+	if !ok {
+		return nil, errBadFid
+	}
+	return fid, nil
+}
+
+// newFid associates fid with the unused fid number n.
+func (c *dotlConn) newFid(n uint32, fid *dotlFid) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.fids[n]; ok {
+		return errFidUsed
+	}
+	c.fids[n] = fid
+	return nil
+}
+
+// delFid disassociates and returns the fid numbered n.
+func (c *dotlConn) delFid(n uint32) (*dotlFid, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	fid, ok := c.fids[n]
+	if !ok {
+		return nil, errBadFid
+	}
+	delete(c.fids, n)
+	return fid, nil
+}
+
+func (c *dotlConn) auth(d *ldec, r *lenc) error {
+	n := d.u32()
+	d.str() // uname, checked by attach
+	aname := d.str()
+	d.u32() // n_uname
+	if d.err != nil {
+		return d.err
+	}
+	a, err := c.fs.authInit(aname)
+	if err != nil {
+		return err
+	}
+	if err := c.newFid(n, &dotlFid{Fid: new(Fid), auth: a}); err != nil {
+		return err
+	}
+	r.qid(&a.qid)
+	return nil
+}
+
+func (c *dotlConn) attach(d *ldec, r *lenc) error {
+	n, afid := d.u32(), d.u32()
+	uname, aname := d.str(), d.str()
+	uid := d.u32()
+	if d.err != nil {
+		return d.err
+	}
+	var a *authState
+	if afid != go9p.NOFID {
+		fid, err := c.lookup(afid)
+		if err != nil {
+			return err
+		}
+		if fid.auth == nil {
+			return srv.Ebaduse
+		}
+		a = fid.auth
+	}
+	fid, err := c.fs.attach(uname, aname, a)
+	if err != nil {
+		return err
+	}
+	if uid == go9p.NOUID {
+		uid = 0
+	}
+	fid.uid = uid
+	if err := c.newFid(n, &dotlFid{Fid: fid}); err != nil {
+		return err
+	}
+	r.qid(fid.qid())
+	return nil
+}
+
+func (c *dotlConn) walk(d *ldec, r *lenc) error {
+	n, newn := d.u32(), d.u32()
+	names := make([]string, d.u16())
+	for i := range names {
+		names[i] = d.str()
+	}
+	if d.err != nil {
+		return d.err
+	}
+	fid, err := c.fid(n)
+	if err != nil {
+		return err
+	}
+	if fid.open {
+		return errIsOpen
+	}
+	if newn != n {
+		if _, err := c.fid(newn); err == nil {
+			return errFidUsed
+		}
+	}
+	nfid, wqids, err := c.fs.walk(fid.Fid, names)
+	if err != nil {
+		return err
+	}
+	if len(wqids) == len(names) {
+		c.mu.Lock()
+		c.fids[newn] = &dotlFid{Fid: nfid}
+		c.mu.Unlock()
+	}
+	r.u16(uint16(len(wqids)))
+	for i := range wqids {
+		r.qid(&wqids[i])
+	}
+	return nil
+}
+
+func (c *dotlConn) lopen(d *ldec, r *lenc) error {
+	n, flags := d.u32(), d.u32()
+	if d.err != nil {
+		return d.err
+	}
+	fid, err := c.fid(n)
+	if err != nil {
+		return err
+	}
+	if fid.open {
+		return errIsOpen
+	}
+	if err := c.fs.open(fid.Fid, omode(flags)); err != nil {
+		return err
+	}
+	fid.open = true
+	fid.append = flags&lO_APPEND != 0
+	r.qid(fid.qid())
+	r.u32(0)
+	return nil
+}
+
+func (c *dotlConn) lcreate(d *ldec, r *lenc) error {
+	n := d.u32()
+	name := d.str()
+	flags, mode := d.u32(), d.u32()
+	d.u32() // gid
+	if d.err != nil {
+		return d.err
+	}
+	fid, err := c.fid(n)
+	if err != nil {
+		return err
+	}
+	if fid.open {
+		return errIsOpen
+	}
+	if err := c.fs.create(fid.Fid, name, mode&0777, omode(flags)); err != nil {
+		return err
+	}
+	fid.open = true
+	fid.append = flags&lO_APPEND != 0
+	r.qid(fid.qid())
+	r.u32(0)
+	return nil
+}
+
+func (c *dotlConn) symlink(d *ldec, r *lenc) error {
+	n := d.u32()
+	name, target := d.str(), d.str()
+	d.u32() // gid
+	if d.err != nil {
+		return d.err
+	}
+	dfid, err := c.fid(n)
+	if err != nil {
+		return err
+	}
+	fid := dfid.clone()
+	if err := c.fs.symlink(fid, name, target); err != nil {
+		return err
+	}
+	r.qid(fid.qid())
+	return nil
+}
+
+func (c *dotlConn) readlink(d *ldec, r *lenc) error {
+	n := d.u32()
+	if d.err != nil {
+		return d.err
+	}
+	fid, err := c.fid(n)
+	if err != nil {
+		return err
+	}
+	target, err := c.fs.readlink(fid.Fid)
+	if err != nil {
+		return err
+	}
+	r.str(target)
+	return nil
+}
+
+// omode converts Linux open flags to a 9P open mode.
+func omode(flags uint32) uint8 {
+	mode := uint8(flags & lO_ACCMODE)
+	if flags&lO_TRUNC != 0 {
+		mode |= go9p.OTRUNC
+	}
+	return mode
+}
+
+func (c *dotlConn) read(d *ldec, r *lenc) error {
+	n, off, count := d.u32(), d.u64(), d.u32()
+	if d.err != nil {
+		return d.err
+	}
+	fid, err := c.lookup(n)
+	if err != nil {
+		return err
+	}
+	if max := c.maxMsize() - go9p.IOHDRSZ; count > max {
+		count = max
+	}
+	buf := make([]byte, count)
+	var nr int
+	switch {
+	case fid.auth != nil:
+		nr, err = fid.auth.read(buf, int64(off))
+	case fid.xattr != nil:
+		nr = readData(fid.xattr, buf, int64(off))
+	case !fid.open:
+		return errNotOpen
+	case fid.isDir():
+		return errIsDir
+	default:
+		nr, err = c.fs.read(fid.Fid, buf, int64(off))
+	}
+	if err != nil {
+		return err
+	}
+	r.u32(uint32(nr))
+	*r = append(*r, buf[:nr]...)
+	return nil
+}
+
+func (c *dotlConn) write(d *ldec, r *lenc) error {
+	n, off, count := d.u32(), d.u64(), d.u32()
+	data := d.bytes(int(count))
+	if d.err != nil {
+		return d.err
+	}
+	fid, err := c.lookup(n)
+	if err != nil {
+		return err
+	}
+	var nw int
+	switch {
+	case fid.auth != nil:
+		nw, err = c.fs.authWrite(fid.auth, data)
+	case !fid.open:
+		return errNotOpen
+	default:
+		nw, err = c.fs.write(fid.Fid, data, int64(off))
+	}
+	if err != nil {
+		return err
+	}
+	r.u32(uint32(nw))
+	return nil
+}
+
+func (c *dotlConn) clunk(d *ldec, r *lenc) error {
+	n := d.u32()
+	if d.err != nil {
+		return d.err
+	}
+	fid, err := c.delFid(n)
+	if err != nil {
+		return err
+	}
+	return c.fs.clunk(fid.Fid)
+}
+
+func (c *dotlConn) remove(d *ldec, r *lenc) error {
+	n := d.u32()
+	if d.err != nil {
+		return d.err
+	}
+	fid, err := c.delFid(n)
+	if err != nil {
+		return err
+	}
+	if fid.auth != nil {
+		return srv.Ebaduse
+	}
+	err = c.fs.remove(fid.Fid)
+	c.fs.clunk(fid.Fid)
+	return err
+}
+
+func (c *dotlConn) statfs(d *ldec, r *lenc) error {
+	n := d.u32()
+	if d.err != nil {
+		return d.err
+	}
+	if _, err := c.fid(n); err != nil {
+		return err
+	}
+	// Upspin has no notion of capacity, so only the block
+	// size and maximum name length are meaningful.
+	r.u32(v9fsMagic)
+	r.u32(4096) // bsize
+	r.u64(0)    // blocks
+	r.u64(0)    // bfree
+	r.u64(0)    // bavail
+	r.u64(0)    // files
+	r.u64(0)    // ffree
+	r.u64(0)    // fsid
+	r.u32(255)  // namelen
+	return nil
+}
+
+func (c *dotlConn) getattr(d *ldec, r *lenc) error {
+	n := d.u32()
+	d.u64() // request mask; we always return the basic set
+	if d.err != nil {
+		return d.err
+	}
+	fid, err := c.fid(n)
+	if err != nil {
+		return err
+	}
+	st := c.fs.stat(fid.Fid)
+	// Only the attaching user has a known uid, so every file is
+	// reported as its own, with the rights of its Upspin user in
+	// the owner bits and those of all users in the others.
+	perm := st.Mode & 7
+	switch string(fid.id.cfg.UserName()) {
+	case st.Uid:
+		perm = st.Mode >> 6 & 7
+	case st.Gid:
+		perm = st.Mode >> 3 & 7
+	}
+	mode := perm<<6 | st.Mode&7<<3 | st.Mode&7
+	switch {
+	case st.Mode&go9p.DMDIR != 0:
+		mode |= sIFDIR
+	case st.Mode&go9p.DMSYMLINK != 0:
+		mode |= sIFLNK | 0777
+	default:
+		mode |= sIFREG
+	}
+	r.u64(getattrBasic)
+	r.qid(&st.Qid)
+	r.u32(mode)
+	r.u32(fid.uid)
+	r.u32(nobodyGID)
+	r.u64(1) // nlink
+	r.u64(0) // rdev
+	r.u64(st.Length)
+	r.u64(4096)                    // blksize
+	r.u64((st.Length + 511) / 512) // blocks
+	for i := 0; i < 3; i++ {
+		// atime, mtime, ctime
+		r.u64(uint64(st.Mtime))
+		r.u64(0)
+	}
+	r.u64(0) // btime
+	r.u64(0)
+	r.u64(0) // gen
+	r.u64(0) // data_version
+	return nil
+}
+
+func (c *dotlConn) setattr(d *ldec, r *lenc) error {
+	n, valid := d.u32(), d.u32()
+	mode := d.u32()
+	d.u32() // uid
+	d.u32() // gid
+	size := d.u64()
+	d.u64() // atime
+	d.u64()
+	mtime := d.u64()
+	d.u64()
+	if d.err != nil {
+		return d.err
+	}
+	fid, err := c.fid(n)
+	if err != nil {
+		return err
+	}
+	if fid.synth != nil {
+		// Allow truncating the synthetic files when opened by a shell.
+		return nil
+	}
+	// Permissions are set by Access files, so changing them is refused.
+	// Numeric uids and gids do not name Upspin users and there is no
+	// access time, so those changes are accepted and ignored.
+	if valid&setattrMode != 0 && mode&0777 != c.fs.stat(fid.Fid).Mode&0777 {
+		return errWstatMode
+	}
+	if valid&setattrSize != 0 {
+		if err := c.fs.truncate(fid.Fid, int64(size)); err != nil {
+			return err
+		}
+	}
+	if valid&setattrMTime != 0 {
+		t := upspin.Now()
+		if valid&setattrMTimeSet != 0 {
+			t = upspin.Time(mtime)
+		}
+		if err := c.fs.setTime(fid.Fid, t); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *dotlConn) readdir(d *ldec, r *lenc) error {
+	n, off, count := d.u32(), d.u64(), d.u32()
+	if d.err != nil {
+		return d.err
+	}
+	fid, err := c.fid(n)
+	if err != nil {
+		return err
+	}
+	if !fid.open {
+		return errNotOpen
+	}
+	if !fid.isDir() {
+		return errNotDir
+	}
+	// The offset of an entry is its index in fid.dirs plus one,
+	// so that offset 0 starts at the beginning.
+	var ents lenc
+	for i := off; i < uint64(len(fid.dirs)); i++ {
+		st := fid.dirs[i]
+		var ent lenc
+		ent.qid(&st.Qid)
+		ent.u64(i + 1)
+		switch {
+		case st.Mode&go9p.DMDIR != 0:
+			ent.u8(dtDIR)
+		case st.Mode&go9p.DMSYMLINK != 0:
+			ent.u8(dtLNK)
+		default:
+			ent.u8(dtREG)
+		}
+		ent.str(st.Name)
+		if len(ents)+len(ent) > int(count) {
+			break
+		}
+		ents = append(ents, ent...)
+	}
+	r.u32(uint32(len(ents)))
+	*r = append(*r, ents...)
+	return nil
+}
+
+func (c *dotlConn) fsync(d *ldec, r *lenc) error {
+	n := d.u32()
+	if d.err != nil {
+		return d.err
+	}
+	fid, err := c.fid(n)
+	if err != nil {
+		return err
+	}
+	return c.fs.fsync(fid.Fid)
+}
+
+func (c *dotlConn) mkdir(d *ldec, r *lenc) error {
+	n := d.u32()
+	name := d.str()
+	mode := d.u32()
+	d.u32() // gid
+	if d.err != nil {
+		return d.err
+	}
+	dfid, err := c.fid(n)
+	if err != nil {
+		return err
+	}
+	fid := dfid.clone()
+	if err := c.fs.create(fid, name, mode&0777|go9p.DMDIR, 0); err != nil {
+		return err
+	}
+	c.fs.clunk(fid)
+	r.qid(fid.qid())
+	return nil
+}
+
+func (c *dotlConn) renameat(d *ldec, r *lenc) error {
+	oldn := d.u32()
+	oldname := d.str()
+	newn := d.u32()
+	newname := d.str()
+	if d.err != nil {
+		return d.err
+	}
+	olddir, err := c.fid(oldn)
+	if err != nil {
+		return err
+	}
+	newdir, err := c.fid(newn)
+	if err != nil {
+		return err
+	}
+	if !validName(oldname) || !validName(newname) {
+		return errBadName
+	}
+	fid := olddir.clone()
+	fid.path = join(olddir.path, oldname)
+	newpath := join(newdir.path, newname)
+	if err := c.fs.checkWritable(fid, fid.path); err != nil {
+		return err
+	}
+	if err := c.fs.checkWritable(fid, newpath); err != nil {
+		return err
+	}
+	if _, err := fid.id.client.Lookup(fid.path, false); err != nil {
+		return err
+	}
+	if fid.path == newpath {
+		return nil
+	}
+	// Unlike 9P2000, POSIX rename replaces an existing file. It is
+	// moved aside first, and put back should the rename fail.
+	entry, err := fid.id.client.Lookup(newpath, false)
+	if err != nil || entry.IsDir() {
+		return c.fs.rename(fid, newpath)
+	}
+	aside := newpath + upspin.PathName(fmt.Sprintf(".9upspinfs-%d", time.Now().UnixNano()))
+	if _, err := fid.id.client.Rename(newpath, aside); err != nil {
+		return err
+	}
+	if err := c.fs.rename(fid, newpath); err != nil {
+		if _, rerr := fid.id.client.Rename(aside, newpath); rerr != nil {
+			log.Error.Printf("9upspinfs: renameat: restoring %s from %s: %v", newpath, aside, rerr)
+		}
+		return err
+	}
+	if err := fid.id.client.Delete(aside); err != nil {
+		log.Error.Printf("9upspinfs: renameat: removing %s: %v", aside, err)
+	}
+	return nil
+}
+
+func (c *dotlConn) unlinkat(d *ldec, r *lenc) error {
+	n := d.u32()
+	name := d.str()
+	d.u32() // flags
+	if d.err != nil {
+		return d.err
+	}
+	dir, err := c.fid(n)
+	if err != nil {
+		return err
+	}
+	if !validName(name) {
+		return errBadName
+	}
+	fid := dir.clone()
+	fid.path = join(dir.path, name)
+	return c.fs.remove(fid)
+}
+
+// ldec decodes the fields of a 9P message. Running past the end
+// of the message sets err and yields zero values.
+type ldec struct {
+	b   []byte
+	err error
+}
+
+func (d *ldec) bytes(n int) []byte {
+	if n < 0 || len(d.b) < n {
+		d.err = errBadMsg
+		d.b = nil
+		return nil
+	}
+	b := d.b[:n]
+	d.b = d.b[n:]
+	return b
+}
+
+func (d *ldec) u8() uint8 {
+	if b := d.bytes(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (d *ldec) u16() uint16 {
+	if b := d.bytes(2); b != nil {
+		return binary.LittleEndian.Uint16(b)
+	}
+	return 0
+}
+
+func (d *ldec) u32() uint32 {
+	if b := d.bytes(4); b != nil {
+		return binary.LittleEndian.Uint32(b)
+	}
+	return 0
+}
+
+func (d *ldec) u64() uint64 {
+	if b := d.bytes(8); b != nil {
+		return binary.LittleEndian.Uint64(b)
+	}
+	return 0
+}
+
+func (d *ldec) str() string {
+	return string(d.bytes(int(d.u16())))
+}
+
+// lenc encodes the fields of a 9P message.
+type lenc []byte
+
+func (e *lenc) u8(v uint8) {
+	*e = append(*e, v)
+}
+
+func (e *lenc) u16(v uint16) {
+	*e = append(*e, byte(v), byte(v>>8))
+}
+
+func (e *lenc) u32(v uint32) {
+	e.u16(uint16(v))
+	e.u16(uint16(v >> 16))
+}
+
+func (e *lenc) u64(v uint64) {
+	e.u32(uint32(v))
+	e.u32(uint32(v >> 32))
+}
+
+func (e *lenc) str(s string) {
+	e.u16(uint16(len(s)))
+	*e = append(*e, s...)
+}
+
+func (e *lenc) qid(q *go9p.Qid) {
+	e.u8(q.Type)
+	e.u32(q.Version)
+	e.u64(q.Path)
+}
@@ -0,0 +1,125 @@
+// Copyright 2018 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// This file implements Access.effective, a read-only file in every
+// directory describing the access to it: the Access file governing it,
+// the rights it grants to each user and group it names, and the rights
+// of each user once the groups are expanded.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+
+	"upspin.io/access"
+	"upspin.io/upspin"
+
+	go9p "github.com/lionkov/go9p/p"
+)
+
+// effectiveFile is the name of the access description in each directory.
+const effectiveFile = "Access.effective"
+
+var errEffective = &go9p.Error{Err: "Access.effective is read-only", Errornum: go9p.EPERM}
+
+// effectiveRights are the rights reported in Access.effective.
+var effectiveRights = []access.Right{access.Read, access.Write, access.List, access.Create, access.Delete}
+
+// effectiveQid returns the qid of the Access.effective file in dir.
+func effectiveQid(dir upspin.PathName) *go9p.Qid {
+	return &go9p.Qid{Path: qidpath(dir + "/" + effectiveFile)}
+}
+
+// effectiveDir returns the directory entry of the Access.effective file
+// in the directory d. It has no length, since its contents are produced
+// when it is opened.
+func (f *upspinFS) effectiveDir(id *identity, d *upspin.DirEntry) *go9p.Dir {
+	dir := f.dir2Dir(id, string(d.Name), d)
+	dir.Qid = *effectiveQid(d.Name)
+	dir.Mode = 0444
+	dir.Length = 0
+	dir.Name = effectiveFile
+	return dir
+}
+
+// openEffective opens fid, which refers to an Access.effective file.
+func (f *upspinFS) openEffective(fid *Fid, mode uint8) error {
+	if mode&3 != go9p.OREAD {
+		return errEffective
+	}
+	text, err := effectiveText(fid.id, fid.entry)
+	if err != nil {
+		return err
+	}
+	fid.synthData = text
+	return nil
+}
+
+// effectiveText returns the description of the access to the directory d.
+func effectiveText(id *identity, d *upspin.DirEntry) ([]byte, error) {
+	var b bytes.Buffer
+	acc, err := id.access(d)
+	if err != nil {
+		return nil, err
+	}
+	if acc == nil {
+		u, err := defaultUser(d.Name)
+		if err != nil {
+			return nil, err
+		}
+		fmt.Fprintf(&b, "governed by: none\n")
+		fmt.Fprintf(&b, "effective:\n\t%s %s\n", u, rightNames(effectiveRights))
+		return b.Bytes(), nil
+	}
+	fmt.Fprintf(&b, "governed by: %s\n", acc.Path())
+
+	// The users and groups named in the Access file.
+	granted := make(map[string][]access.Right)
+	for _, r := range effectiveRights {
+		for _, p := range acc.List(r) {
+			granted[p.String()] = append(granted[p.String()], r)
+		}
+	}
+	fmt.Fprintf(&b, "granted:\n")
+	writeRights(&b, granted)
+
+	// The users, with groups expanded.
+	effective := make(map[string][]access.Right)
+	for _, r := range effectiveRights {
+		users, err := acc.Users(r, id.client.Get)
+		if err != nil {
+			return nil, err
+		}
+		for _, u := range users {
+			effective[string(u)] = append(effective[string(u)], r)
+		}
+	}
+	fmt.Fprintf(&b, "effective:\n")
+	writeRights(&b, effective)
+	return b.Bytes(), nil
+}
+
+// writeRights writes a line for each name in m with its rights.
+func writeRights(b *bytes.Buffer, m map[string][]access.Right) {
+	names := make([]string, 0, len(m))
+	for name := range m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(b, "\t%s %s\n", name, rightNames(m[name]))
+	}
+}
+
+// rightNames returns the names of rights separated by commas.
+func rightNames(rights []access.Right) string {
+	names := make([]string, len(rights))
+	for i, r := range rights {
+		names[i] = r.String()
+	}
+	return strings.Join(names, ",")
+}
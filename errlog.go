@@ -0,0 +1,89 @@
+// Copyright 2018 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"upspin.io/log"
+	"upspin.io/upspin"
+)
+
+// maxErrorLog is the size beyond which the error log is
+// moved aside, to <name>.old, and started afresh.
+const maxErrorLog = 1 << 20
+
+// errorLog records the files that could not be stored, so that failures
+// noticed by nobody, such as those of files still being written when a
+// client went away, are not lost. It is kept in a file under the cache
+// directory, which survives restarts, or else in memory.
+type errorLog struct {
+	mu   sync.Mutex
+	name string       // file holding the log; empty to keep it in buf
+	buf  bytes.Buffer // the log, if not kept in a file
+}
+
+func newErrorLog(cacheDir string) *errorLog {
+	l := new(errorLog)
+	if cacheDir != "" {
+		l.name = filepath.Join(cacheDir, "9upspinfs", "errors")
+	}
+	return l
+}
+
+// add records that the file name written by user u could not be stored.
+func (l *errorLog) add(u upspin.UserName, name upspin.PathName, err error) {
+	line := fmt.Sprintf("%s %s %s: %v\n", time.Now().UTC().Format(time.RFC3339), u, name, err)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.name == "" {
+		l.buf.WriteString(line)
+		return
+	}
+	if err := l.append(line); err != nil {
+		log.Error.Printf("9upspinfs: error log: %v; lost %s", err, line)
+	}
+}
+
+// append appends line to the log file. l.mu must be held.
+func (l *errorLog) append(line string) error {
+	if err := os.MkdirAll(filepath.Dir(l.name), 0700); err != nil {
+		return err
+	}
+	if fi, err := os.Stat(l.name); err == nil && fi.Size() > maxErrorLog {
+		if err := os.Rename(l.name, l.name+".old"); err != nil {
+			return err
+		}
+	}
+	f, err := os.OpenFile(l.name, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.WriteString(line); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// contents returns the log.
+func (l *errorLog) contents() []byte {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.name == "" {
+		return append([]byte(nil), l.buf.Bytes()...)
+	}
+	data, err := ioutil.ReadFile(l.name)
+	if err != nil && !os.IsNotExist(err) {
+		log.Error.Printf("9upspinfs: error log: %v", err)
+	}
+	return data
+}
@@ -0,0 +1,223 @@
+// Copyright 2018 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// This file implements exports: the aname of an attach selects the
+// subtree the client sees, and the export may restrict what the client
+// can do there. An attach with an empty aname sees the synthetic root
+// holding the directory of every user, as before.
+
+package main
+
+import (
+	"io/ioutil"
+	"strings"
+
+	"upspin.io/config"
+	"upspin.io/errors"
+	"upspin.io/pack"
+	"upspin.io/path"
+	"upspin.io/upspin"
+
+	go9p "github.com/lionkov/go9p/p"
+	"github.com/lionkov/go9p/p/srv"
+)
+
+// export is a subtree of Upspin served as the root of an attach.
+type export struct {
+	name     string
+	root     upspin.PathName          // without a trailing slash
+	readOnly bool                     // the subtree may not be changed
+	allow    map[upspin.UserName]bool // if not empty, users allowed to attach instead of -allow
+	packer   upspin.Packer            // if not nil, packing of the files written instead of the user's
+
+	ids map[*identity]*identity // identities using packer; protected by upspinFS.mu
+}
+
+var errNoExport = &go9p.Error{Err: "no such export", Errornum: go9p.ENOENT}
+
+// readExports reads the exports table in file.
+func readExports(file string) (map[string]*export, error) {
+	const op errors.Op = "9upspinfs.readExports"
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, errors.E(op, err)
+	}
+	exports, err := parseExports(string(data))
+	if err != nil {
+		return nil, errors.E(op, errors.Errorf("%s: %v", file, err))
+	}
+	return exports, nil
+}
+
+// parseExports parses an exports table. Each line holds the name of an
+// export, its root and its options:
+//
+//	name path [readonly] [allow=user,...] [packing=name]
+//
+// Blank lines and lines starting with # are ignored.
+func parseExports(s string) (map[string]*export, error) {
+	exports := make(map[string]*export)
+	for i, line := range strings.Split(s, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) < 2 {
+			return nil, errors.Errorf("line %d: missing path", i+1)
+		}
+		e, err := newExport(fields[0], fields[1])
+		if err != nil {
+			return nil, errors.Errorf("line %d: %v", i+1, err)
+		}
+		if _, ok := exports[e.name]; ok {
+			return nil, errors.Errorf("line %d: duplicate export %s", i+1, e.name)
+		}
+		for _, opt := range fields[2:] {
+			if err := e.setOption(opt); err != nil {
+				return nil, errors.Errorf("line %d: %v", i+1, err)
+			}
+		}
+		exports[e.name] = e
+	}
+	return exports, nil
+}
+
+// newExport returns an export called name of the tree at root,
+// with no options set.
+func newExport(name, root string) (*export, error) {
+	p, err := path.Parse(upspin.PathName(root))
+	if err != nil {
+		return nil, err
+	}
+	return &export{
+		name: name,
+		root: upspin.PathName(strings.TrimSuffix(string(p.Path()), "/")),
+		ids:  make(map[*identity]*identity),
+	}, nil
+}
+
+// setOption sets an option of e given in the exports table.
+func (e *export) setOption(opt string) error {
+	key, val := opt, ""
+	if i := strings.IndexByte(opt, '='); i >= 0 {
+		key, val = opt[:i], opt[i+1:]
+	}
+	switch key {
+	case "readonly":
+		if val != "" {
+			break
+		}
+		e.readOnly = true
+		return nil
+	case "allow":
+		allow, err := parseAllow(val)
+		if err != nil {
+			return err
+		}
+		e.allow = allow
+		return nil
+	case "packing":
+		e.packer = pack.LookupByName(val)
+		if e.packer == nil {
+			return errors.Errorf("unknown packing %q", val)
+		}
+		return nil
+	}
+	return errors.Errorf("bad option %q", opt)
+}
+
+// export returns the export selected by aname: one named in the exports
+// table, or else the tree at the Upspin path aname with no options set.
+// It returns nil for an empty aname, which selects the whole tree.
+// If there is an exports table, only the exports it names may be
+// selected, since the others would reach the same trees without their
+// options.
+func (f *upspinFS) export(aname string) (*export, error) {
+	if e, ok := f.exports[aname]; ok {
+		return e, nil
+	}
+	if len(f.exports) > 0 {
+		return nil, errNoExport
+	}
+	if aname == "" {
+		return nil, nil
+	}
+	e, err := newExport(aname, aname)
+	if err != nil {
+		return nil, errNoExport
+	}
+	return e, nil
+}
+
+// allowed returns the users allowed to attach to e. If it is empty,
+// anyone may attach without authenticating.
+func (f *upspinFS) allowed(e *export) map[upspin.UserName]bool {
+	if e != nil && len(e.allow) > 0 {
+		return e.allow
+	}
+	return f.allow
+}
+
+// exportIdentity returns the identity that id uses within e,
+// which differs from id if e sets the packing.
+func (f *upspinFS) exportIdentity(id *identity, e *export) *identity {
+	if e == nil || e.packer == nil {
+		return id
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if eid, ok := e.ids[id]; ok {
+		return eid
+	}
+	eid := newIdentity(config.SetPacking(id.cfg, e.packer.Packing()), f.cacheDir)
+	e.ids[id] = eid
+	return eid
+}
+
+// attach returns the fid of the root of the export selected by aname,
+// acting as the 9P user uname, authenticated by a if it is not nil.
+func (f *upspinFS) attach(uname, aname string, a *authState) (*Fid, error) {
+	e, err := f.export(aname)
+	if err != nil {
+		return nil, err
+	}
+	if err := f.authCheck(uname, e, a); err != nil {
+		return nil, err
+	}
+	id, err := f.identity(uname)
+	if err != nil {
+		return nil, err
+	}
+	if e == nil {
+		return &Fid{id: id}, nil
+	}
+	id = f.exportIdentity(id, e)
+	entry, err := id.client.Lookup(e.root, false)
+	if err != nil {
+		return nil, errNoExport
+	}
+	if !entry.IsDir() {
+		return nil, srv.Enotdir
+	}
+	return &Fid{id: id, export: e, path: e.root, entry: entry}, nil
+}
+
+// parent returns the directory holding name, reached by walking "..".
+// Walks never leave the root of the export e.
+func parent(e *export, name upspin.PathName) upspin.PathName {
+	var dir upspin.PathName
+	if i := strings.LastIndexByte(string(name), '/'); i >= 0 {
+		dir = name[:i]
+	}
+	if e != nil && (dir == "" || within(name, e.root) && !within(dir, e.root)) {
+		return e.root
+	}
+	return dir
+}
+
+// within reports whether name is root or below it, once cleaned.
+func within(name, root upspin.PathName) bool {
+	name, root = path.Clean(name), path.Clean(root)
+	return name == root || strings.HasPrefix(string(name), string(root)+"/")
+}
@@ -9,7 +9,21 @@
 package main
 
 import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"upspin.io/access"
+	"upspin.io/bind"
+	"upspin.io/client/clientutil"
 	"upspin.io/errors"
+	"upspin.io/pack"
+	"upspin.io/path"
 	"upspin.io/upspin"
 )
 
@@ -18,50 +32,133 @@ import (
 // In the tests, we cut it down to manageable size for overflow checking.
 var maxInt = int64(^uint(0) >> 1)
 
+// spillSize is the size beyond which the contents of a writable file
+// are moved from memory to a temporary file.
+const spillSize = upspin.BlockSize
+
 // File is a simple implementation of upspin.File.
-// It always keeps the whole file in memory under the assumption
-// that it is encrypted and must be read and written atomically.
+// Readers fetch and unpack only the blocks covering each read.
+// Writers keep small files in memory and larger ones in a temporary
+// file, and upload the whole file when closed.
 type File struct {
+	mu       sync.Mutex      // Serializes the methods of upspin.File.
 	name     upspin.PathName // Full path name.
 	offset   int64           // File location for next read or write operation. Constrained to <= maxInt.
 	writable bool            // File is writable (made with Create, not Open).
 	closed   bool            // Whether the file has been closed, preventing further operations.
+	config   upspin.Config
+	size     int64
 
 	// Used only by readers.
-	config upspin.Config
 	entry  *upspin.DirEntry
-	size   int64
 	bu     upspin.BlockUnpacker
+	blocks *blockCache // Cache of unpacked blocks; may be nil.
 	// Keep the most recently unpacked block around
 	// in case a subsequent readAt starts at the same place.
 	lastBlockIndex int
 	lastBlockBytes []byte
 
 	// Used only by writers.
-	client upspin.Client // Client the File belongs to.
-	data   []byte        // Contents of file.
+	client   upspin.Client   // Client the File belongs to.
+	target   upspin.PathName // Name the contents are stored as: name, with links followed.
+	data     []byte          // Contents of file, until it is spilled.
+	spill    *os.File        // Contents of file once larger than spillSize.
+	spillDir string          // Directory for spill; empty for the default.
+	mtime    upspin.Time     // If not zero, modification time to set when stored.
+	seq      int64           // Sequence of the entry the contents are based on.
+	journal  bool            // Keep the contents in spillDir, with an index, once changed.
+	index    string          // Name of the index of the journaled contents.
+	orclose  bool            // To be removed once closed, so never recovered.
+	conflict bool            // Changed in Upspin since opened, so stored as a sibling, target.
 }
 
 var _ upspin.File = (*File)(nil)
 
-// Writable creates a new file with a given name, belonging to a given
-// client for write. Once closed, the file will overwrite any existing
-// file with the same name.
-func Writable(client upspin.Client, name upspin.PathName, truncate bool) (*File, error) {
-	var data []byte
-	if !truncate {
-		var err error
-		data, err = client.Get(name)
-		if err != nil {
-			return nil, err
-		}
+// Readable creates a new file for reading the contents of entry.
+// Blocks are looked for in, and added to, blocks, which may be nil.
+func Readable(cfg upspin.Config, entry *upspin.DirEntry, blocks *blockCache) (*File, error) {
+	const op errors.Op = "file.Readable"
+	packer := pack.Lookup(entry.Packing)
+	if packer == nil {
+		return nil, errors.E(op, entry.Name, errors.Invalid, errors.Errorf("unrecognized Packing %d", entry.Packing))
+	}
+	bu, err := packer.Unpack(cfg, entry)
+	if err != nil {
+		return nil, errors.E(op, entry.Name, err)
+	}
+	size, err := entry.Size()
+	if err != nil {
+		bu.Close()
+		return nil, errors.E(op, entry.Name, err)
 	}
 	return &File{
+		name:           entry.Name,
+		config:         cfg,
+		size:           size,
+		entry:          entry,
+		bu:             bu,
+		blocks:         blocks,
+		lastBlockIndex: -1,
+	}, nil
+}
+
+// Writable creates a new file with a given name, belonging to a given
+// client for write. Once closed, the file will overwrite the file with
+// the same name, as long as it has not changed in the meantime; if name
+// is a link, or lies under one, the file it refers to is written. Unless
+// truncate is set, the file starts with the current contents of name.
+// Temporary files holding large contents are created in spillDir. If
+// journal is set, the contents are kept there from their first change,
+// with an index describing them, so that they can be stored should the
+// server die first.
+func Writable(cfg upspin.Config, client upspin.Client, name upspin.PathName, truncate bool, spillDir string, journal bool) (*File, error) {
+	const op errors.Op = "file.Writable"
+	f := &File{
+		config:   cfg,
 		client:   client,
 		name:     name,
 		writable: true,
-		data:     data,
-	}, nil
+		spillDir: spillDir,
+	}
+	// The final link is followed so as to bypass the cache of
+	// entries, which could hold an old sequence.
+	entry, err := client.Lookup(name, true)
+	switch {
+	case err == nil:
+		// The contents are stored, as by client.Put, in the
+		// file the links lead to.
+		f.target = entry.Name
+		f.seq = entry.Sequence
+	case truncate && errors.Is(errors.NotExist, err):
+		f.target = name
+		f.seq = upspin.SeqNotExist
+	default:
+		return nil, err
+	}
+	if truncate {
+		f.journal = journal
+		return f, nil
+	}
+	r, err := Readable(cfg, entry, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	buf := make([]byte, upspin.BlockSize)
+	for off := int64(0); off < r.size; {
+		n, err := r.readAt(op, buf, off)
+		if err != nil && err != io.EOF {
+			f.release()
+			return nil, err
+		}
+		if _, err := f.writeAt(op, buf[:n], off); err != nil {
+			f.release()
+			return nil, err
+		}
+		off += int64(n)
+	}
+	f.journal = journal
+	return f, nil
 }
 
 // Name implements upspin.File.
@@ -71,27 +168,204 @@ func (f *File) Name() upspin.PathName {
 
 // Read implements upspin.File.
 func (f *File) Read(b []byte) (n int, err error) {
-	panic("not implemented")
+	const op errors.Op = "file.Read"
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	n, err = f.readAt(op, b, f.offset)
+	f.offset += int64(n)
+	return n, err
 }
 
 // ReadAt implements upspin.File.
 func (f *File) ReadAt(b []byte, off int64) (n int, err error) {
-	panic("not implemented")
+	const op errors.Op = "file.ReadAt"
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.readAt(op, b, off)
+}
+
+func (f *File) readAt(op errors.Op, dst []byte, off int64) (n int, err error) {
+	if f.closed {
+		return 0, f.errClosed(op)
+	}
+	if off < 0 {
+		return 0, errors.E(op, errors.Invalid, f.name, "negative offset")
+	}
+	if f.writable {
+		return f.readWritable(op, dst, off)
+	}
+	for n < len(dst) {
+		if off >= f.size {
+			return n, io.EOF
+		}
+		// Find the block holding off.
+		blocks := f.entry.Blocks
+		i := sort.Search(len(blocks), func(i int) bool {
+			return blocks[i].Offset+blocks[i].Size > off
+		})
+		if i == len(blocks) {
+			return n, io.EOF
+		}
+		clear, err := f.block(op, i)
+		if err != nil {
+			return n, err
+		}
+		start := off - blocks[i].Offset
+		if start < 0 || start > int64(len(clear)) {
+			return n, errors.E(op, errors.IO, f.name, "block offsets out of order")
+		}
+		m := copy(dst[n:], clear[start:])
+		n += m
+		off += int64(m)
+	}
+	return n, nil
+}
+
+// block returns the cleartext of block i.
+func (f *File) block(op errors.Op, i int) ([]byte, error) {
+	if i == f.lastBlockIndex {
+		return f.lastBlockBytes, nil
+	}
+	b, ok := f.bu.SeekBlock(i)
+	if !ok {
+		return nil, errors.E(op, errors.IO, f.name, errors.Errorf("could not seek to block %d", i))
+	}
+	key := blockKey(b.Location)
+	if clear, ok := f.blocks.get(key); ok && int64(len(clear)) == b.Size {
+		f.lastBlockIndex = i
+		f.lastBlockBytes = clear
+		return clear, nil
+	}
+	cipher, err := clientutil.ReadLocation(f.config, b.Location)
+	if err != nil {
+		return nil, errors.E(op, f.name, err)
+	}
+	clear, err := f.bu.Unpack(cipher)
+	if err != nil {
+		return nil, errors.E(op, f.name, err)
+	}
+	f.blocks.put(key, clear)
+	f.lastBlockIndex = i
+	f.lastBlockBytes = clear
+	return clear, nil
+}
+
+// Append writes b at the end of the file.
+func (f *File) Append(b []byte) (n int, err error) {
+	const op errors.Op = "file.Append"
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.writeAt(op, b, f.size)
+}
+
+// Truncate changes the size of a writable file, discarding
+// its end or extending it with zeros.
+func (f *File) Truncate(size int64) error {
+	const op errors.Op = "file.Truncate"
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return f.errClosed(op)
+	}
+	if !f.writable {
+		return errors.E(op, errors.Invalid, f.name, "not open for write")
+	}
+	if size < 0 || size > maxInt {
+		return errors.E(op, errors.Invalid, f.name, "bad size")
+	}
+	if err := f.startJournal(op); err != nil {
+		return err
+	}
+	if f.spill == nil && size > spillSize {
+		if err := f.spillData(op); err != nil {
+			return err
+		}
+	}
+	switch {
+	case f.spill != nil:
+		if err := f.spill.Truncate(size); err != nil {
+			return errors.E(op, errors.IO, f.name, err)
+		}
+	case size < int64(len(f.data)):
+		// Clear the end, which writeAt may bring back into use.
+		tail := f.data[size:]
+		for i := range tail {
+			tail[i] = 0
+		}
+		f.data = f.data[:size]
+	default:
+		f.data = append(f.data, make([]byte, size-int64(len(f.data)))...)
+	}
+	f.size = size
+	return nil
+}
+
+// setTime sets the modification time given to the file when it is stored.
+func (f *File) setTime(t upspin.Time) {
+	f.mu.Lock()
+	f.mtime = t
+	f.mu.Unlock()
+}
+
+// readWritable reads the contents of a writable file.
+func (f *File) readWritable(op errors.Op, dst []byte, off int64) (n int, err error) {
+	if off >= f.size {
+		return 0, io.EOF
+	}
+	if f.spill != nil {
+		n, err = f.spill.ReadAt(dst, off)
+		if err != nil && err != io.EOF {
+			return n, errors.E(op, errors.IO, f.name, err)
+		}
+	} else {
+		n = copy(dst, f.data[off:])
+	}
+	if n < len(dst) {
+		return n, io.EOF
+	}
+	return n, nil
 }
 
 // Seek implements upspin.File.
 func (f *File) Seek(offset int64, whence int) (ret int64, err error) {
-	panic("not implemented")
+	const op errors.Op = "file.Seek"
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return 0, f.errClosed(op)
+	}
+	switch whence {
+	case io.SeekStart:
+		ret = offset
+	case io.SeekCurrent:
+		ret = f.offset + offset
+	case io.SeekEnd:
+		ret = f.size + offset
+	default:
+		return 0, errors.E(op, errors.Invalid, f.name, "bad whence")
+	}
+	if ret < 0 || offset > maxInt || ret > maxInt {
+		return 0, errors.E(op, errors.Invalid, f.name, "bad offset")
+	}
+	f.offset = ret
+	return ret, nil
 }
 
 // Write implements upspin.File.
 func (f *File) Write(b []byte) (n int, err error) {
-	panic("not implemented")
+	const op errors.Op = "file.Write"
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	n, err = f.writeAt(op, b, f.offset)
+	f.offset += int64(n)
+	return n, err
 }
 
 // WriteAt implements upspin.File.
 func (f *File) WriteAt(b []byte, off int64) (n int, err error) {
 	const op errors.Op = "file.WriteAt"
+	f.mu.Lock()
+	defer f.mu.Unlock()
 	return f.writeAt(op, b, off)
 }
 
@@ -109,6 +383,38 @@ func (f *File) writeAt(op errors.Op, b []byte, off int64) (n int, err error) {
 	if end > maxInt {
 		return 0, errors.E(op, errors.Invalid, f.name, "file too long")
 	}
+	if access.IsAccessControlFile(f.target) {
+		// Check the contents the write would leave, so that
+		// a write making them malformed changes nothing.
+		data, err := f.contents(op)
+		if err != nil {
+			return 0, err
+		}
+		if end > int64(len(data)) {
+			data = append(data, make([]byte, end-int64(len(data)))...)
+		}
+		copy(data[off:], b)
+		if err := f.validate(op, data, false); err != nil {
+			return 0, err
+		}
+	}
+	if err := f.startJournal(op); err != nil {
+		return 0, err
+	}
+	if f.spill == nil && end > spillSize {
+		if err := f.spillData(op); err != nil {
+			return 0, err
+		}
+	}
+	if f.spill != nil {
+		if _, err := f.spill.WriteAt(b, off); err != nil {
+			return 0, errors.E(op, errors.IO, f.name, err)
+		}
+		if end > f.size {
+			f.size = end
+		}
+		return len(b), nil
+	}
 	if end > int64(cap(f.data)) {
 		// Grow the capacity of f.data but keep length the same.
 		// Be careful not to ask for more than an int's worth of length.
@@ -123,14 +429,74 @@ func (f *File) writeAt(op errors.Op, b []byte, off int64) (n int, err error) {
 	// Capacity is OK now. Fix the length if necessary.
 	if end > int64(len(f.data)) {
 		f.data = f.data[:end]
+		f.size = end
 	}
 	copy(f.data[off:], b)
 	return len(b), nil
 }
 
+// contents returns the contents of a writable file.
+func (f *File) contents(op errors.Op) ([]byte, error) {
+	data := make([]byte, f.size)
+	if _, err := f.readWritable(op, data, 0); err != nil && err != io.EOF {
+		return nil, err
+	}
+	return data, nil
+}
+
+// validate checks that data, the contents of an Access or Group file
+// being written, are well formed, so that mistakes are reported to the
+// writer rather than when the file is stored. Unless complete is set,
+// a final partial line is ignored, since the rest of it may be still
+// to come.
+func (f *File) validate(op errors.Op, data []byte, complete bool) error {
+	if !access.IsAccessControlFile(f.target) {
+		return nil
+	}
+	if !complete {
+		data = data[:bytes.LastIndexByte(data, '\n')+1]
+	}
+	var err error
+	if access.IsAccessFile(f.target) {
+		_, err = access.Parse(f.target, data)
+	} else {
+		var p path.Parsed
+		if p, err = path.Parse(f.target); err == nil {
+			_, err = access.ParseGroup(p, data)
+		}
+	}
+	if err != nil {
+		return errors.E(op, errors.Invalid, f.name, err)
+	}
+	return nil
+}
+
+// spillData moves the contents of the file from memory to a temporary file.
+func (f *File) spillData(op errors.Op) error {
+	if f.spillDir != "" {
+		if err := os.MkdirAll(f.spillDir, 0700); err != nil {
+			return errors.E(op, errors.IO, f.name, err)
+		}
+	}
+	tmp, err := ioutil.TempFile(f.spillDir, "spill")
+	if err != nil {
+		return errors.E(op, errors.IO, f.name, err)
+	}
+	if _, err := tmp.Write(f.data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return errors.E(op, errors.IO, f.name, err)
+	}
+	f.spill = tmp
+	f.data = nil
+	return nil
+}
+
 // Close implements upspin.File.
 func (f *File) Close() error {
 	const op errors.Op = "file.Close"
+	f.mu.Lock()
+	defer f.mu.Unlock()
 	if f.closed {
 		return f.errClosed(op)
 	}
@@ -143,11 +509,284 @@ func (f *File) Close() error {
 		}
 		return nil
 	}
-	_, err := f.client.Put(f.name, f.data)
-	f.data = nil // Might as well release it early.
+	stored, err := f.put()
+	if err != nil && !stored && f.index != "" {
+		// The journal is left for the next run of the server to
+		// store the contents.
+		f.data = nil
+		f.spill.Close()
+		f.spill = nil
+		f.index = ""
+		return err
+	}
+	f.release()
+	return err
+}
+
+// discard closes the file without storing it.
+func (f *File) discard() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.closed = true
+	f.release()
+}
+
+// flush stores the contents written so far, leaving the file open.
+func (f *File) flush() error {
+	const op errors.Op = "file.flush"
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return f.errClosed(op)
+	}
+	if !f.writable {
+		return nil
+	}
+	_, err := f.put()
 	return err
 }
 
+// put stores the contents of a writable file. If the file has changed
+// in Upspin since the contents were based on it, they are stored instead
+// in a sibling, name.conflict-<writer>-<time>, which later stores update,
+// and an error is returned. It reports whether the contents were stored,
+// as they may be even though an error is returned.
+func (f *File) put() (stored bool, err error) {
+	const op errors.Op = "file.put"
+	if access.IsAccessControlFile(f.target) {
+		data, err := f.contents(op)
+		if err != nil {
+			return false, err
+		}
+		if err := f.validate(op, data, true); err != nil {
+			return false, err
+		}
+	}
+	entry, err := f.store(f.target, f.seq)
+	if err != nil && !f.conflict && f.conflicted() {
+		entry, err = f.putConflict(op)
+	}
+	if err != nil {
+		return false, err
+	}
+	f.seq = entry.Sequence
+	if f.mtime != 0 {
+		if err := f.client.SetTime(f.target, f.mtime); err != nil {
+			return true, err
+		}
+		// Setting the time made a new sequence.
+		entry, err := f.client.Lookup(f.target, true)
+		if err != nil {
+			return true, err
+		}
+		f.seq = entry.Sequence
+	}
+	if f.index != "" {
+		// Further changes are based on what was stored.
+		if err := f.writeIndex(op); err != nil {
+			return true, err
+		}
+	}
+	if f.conflict {
+		return true, errors.E(op, f.name, errors.Exist, errors.Errorf("changed since opened; saved as %s", f.target))
+	}
+	return true, nil
+}
+
+// store stores the contents of a writable file as name, provided the
+// sequence of name is seq, as for DirServer.Put.
+func (f *File) store(name upspin.PathName, seq int64) (*upspin.DirEntry, error) {
+	switch {
+	case f.spill == nil:
+		return f.client.PutSequenced(name, seq, f.data)
+	case f.size <= spillSize || access.IsAccessControlFile(name):
+		// Small files, spilled only to be journaled, are stored
+		// by the client like those in memory, which also lets it
+		// validate Access and Group files.
+		data := make([]byte, f.size)
+		if _, err := f.spill.ReadAt(data, 0); err != nil && err != io.EOF {
+			return nil, err
+		}
+		return f.client.PutSequenced(name, seq, data)
+	}
+	return putBlocks(f.config, f.client, name, f.spill, f.size, seq)
+}
+
+// conflicted reports whether the file has changed in Upspin
+// since the contents were based on it.
+func (f *File) conflicted() bool {
+	entry, err := f.client.Lookup(f.target, true)
+	switch {
+	case err == nil:
+		return entry.Name != f.target || entry.Sequence != f.seq
+	case errors.Is(errors.NotExist, err):
+		return f.seq != upspin.SeqNotExist
+	}
+	return false
+}
+
+// putConflict stores the contents of a writable file, which has changed
+// in Upspin, in a new sibling, which becomes the target of later stores.
+func (f *File) putConflict(op errors.Op) (*upspin.DirEntry, error) {
+	name := upspin.PathName(fmt.Sprintf("%s.conflict-%s-%s", f.target, f.config.UserName(), time.Now().UTC().Format("20060102T150405Z")))
+	entry, err := f.store(name, upspin.SeqNotExist)
+	if err != nil {
+		return nil, errors.E(op, f.name, errors.Exist, errors.Errorf("changed since opened, and saving conflicting copy failed: %v", err))
+	}
+	f.target = name
+	f.conflict = true
+	return entry, nil
+}
+
+// length returns the current size of the file.
+func (f *File) length() int64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.size
+}
+
+// release frees the contents of a writable file.
+func (f *File) release() {
+	f.data = nil // Might as well release it early.
+	if f.index != "" {
+		// The index is removed first, so that it never
+		// outlives the contents it describes.
+		os.Remove(f.index)
+		f.index = ""
+	}
+	if f.spill != nil {
+		f.spill.Close()
+		os.Remove(f.spill.Name())
+		f.spill = nil
+	}
+}
+
 func (f *File) errClosed(op errors.Op) error {
 	return errors.E(op, errors.Invalid, f.name, "is closed")
 }
+
+// putBlocks stores the size bytes of r as the contents of the file name,
+// packing and uploading one block at a time as client.PutSequenced does,
+// so the contents never need to be in memory at once.
+func putBlocks(cfg upspin.Config, client upspin.Client, name upspin.PathName, r io.ReaderAt, size int64, seq int64) (*upspin.DirEntry, error) {
+	const op errors.Op = "file.putBlocks"
+	packer := pack.Lookup(cfg.Packing())
+	if packer == nil {
+		return nil, errors.E(op, name, errors.Invalid, errors.Errorf("unrecognized Packing %d", cfg.Packing()))
+	}
+	entry := &upspin.DirEntry{
+		Name:       name,
+		SignedName: name,
+		Packing:    packer.Packing(),
+		Time:       upspin.Now(),
+		Sequence:   seq,
+		Writer:     cfg.UserName(),
+		Attr:       upspin.AttrNone,
+	}
+	store, err := bind.StoreServer(cfg, cfg.StoreEndpoint())
+	if err != nil {
+		return nil, errors.E(op, name, err)
+	}
+	bp, err := packer.Pack(cfg, entry)
+	if err != nil {
+		return nil, errors.E(op, name, err)
+	}
+	buf := make([]byte, upspin.BlockSize)
+	for off := int64(0); off < size; {
+		clear := buf
+		if size-off < int64(len(clear)) {
+			clear = clear[:size-off]
+		}
+		if _, err := r.ReadAt(clear, off); err != nil && err != io.EOF {
+			return nil, errors.E(op, name, errors.IO, err)
+		}
+		cipher, err := bp.Pack(clear)
+		if err != nil {
+			return nil, errors.E(op, name, err)
+		}
+		refdata, err := store.Put(cipher)
+		if err != nil {
+			return nil, errors.E(op, name, err)
+		}
+		bp.SetLocation(upspin.Location{
+			Endpoint:  cfg.StoreEndpoint(),
+			Reference: refdata.Reference,
+		})
+		off += int64(len(clear))
+	}
+	if err := bp.Close(); err != nil {
+		return nil, errors.E(op, name, err)
+	}
+	if packer.Packing() == upspin.EEPack {
+		keys, err := readerKeys(cfg, client, name)
+		if err != nil {
+			return nil, errors.E(op, name, err)
+		}
+		packer.Share(cfg, keys, []*[]byte{&entry.Packdata})
+	}
+	dir, err := client.DirServer(name)
+	if err != nil {
+		return nil, errors.E(op, name, err)
+	}
+	de, err := dir.Put(entry)
+	if err != nil {
+		return nil, err
+	}
+	if de != nil {
+		entry.Sequence = de.Sequence
+	}
+	return entry, nil
+}
+
+// readerKeys returns the public keys of the users who may read
+// the file name: the owner, the user of cfg, and every reader
+// granted by the governing Access file.
+func readerKeys(cfg upspin.Config, client upspin.Client, name upspin.PathName) ([]upspin.PublicKey, error) {
+	p, err := path.Parse(name)
+	if err != nil {
+		return nil, err
+	}
+	readers := []upspin.UserName{p.User()}
+	dir, err := client.DirServer(name)
+	if err != nil {
+		return nil, err
+	}
+	accEntry, err := dir.WhichAccess(name)
+	if err != nil {
+		return nil, err
+	}
+	if accEntry != nil {
+		data, err := client.Get(accEntry.Name)
+		if err != nil {
+			return nil, err
+		}
+		acc, err := access.Parse(accEntry.Name, data)
+		if err != nil {
+			return nil, err
+		}
+		users, err := acc.Users(access.Read, client.Get)
+		if err != nil {
+			return nil, err
+		}
+		readers = append(readers, users...)
+	}
+	key, err := bind.KeyServer(cfg, cfg.KeyEndpoint())
+	if err != nil {
+		return nil, err
+	}
+	keys := []upspin.PublicKey{cfg.Factotum().PublicKey()}
+	seen := map[upspin.UserName]bool{cfg.UserName(): true}
+	for _, r := range readers {
+		if seen[r] || r == access.AllUsers {
+			continue
+		}
+		seen[r] = true
+		u, err := key.Lookup(r)
+		if err != nil || u.PublicKey == "" {
+			// Like client.Put, skip readers without keys.
+			continue
+		}
+		keys = append(keys, u.PublicKey)
+	}
+	return keys, nil
+}
@@ -7,14 +7,14 @@ package main
 import (
 	"crypto/sha1"
 	"io"
-	"os"
 	"path"
 	"runtime"
 	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 
-	"upspin.io/client"
+	"upspin.io/errors"
 	"upspin.io/log"
 	"upspin.io/upspin"
 
@@ -25,158 +25,123 @@ import (
 
 type upspinFS struct {
 	srv.Srv
-	client    upspin.Client
-	userDirs  map[upspin.UserName]bool
-	fileCache *fileCache
+	cfg      upspin.Config
+	allow    map[upspin.UserName]bool // users allowed to attach
+	usersDir string                   // directory of per-user configs
+	cacheDir string                   // directory for our caches and temporary files
+	readOnly bool                     // reject every change to the tree
+	exports  map[string]*export       // exports selected by name in attach
+
+	mu    sync.Mutex // protects ids
+	owner *identity  // identity of cfg
+	ids   map[upspin.UserName]*identity
+
+	nopen int64 // number of open fids; accessed atomically
+
+	omu    sync.Mutex                    // protects opens, rclose and modes
+	opens  map[upspin.PathName]int       // number of open fids of each path
+	rclose map[upspin.PathName]*identity // paths to remove, as the given user, once not open
+	modes  map[upspin.PathName]uint32    // mode bits kept by the server
+
+	locks  lockTable   // byte-range locks of 9P2000.L clients
+	errlog *errorLog   // files that could not be stored
+	blocks *blockCache // blocks read, kept on disk; may be nil
 }
 
 var _ srv.FidOps = (*upspinFS)(nil)
 var _ srv.ReqOps = (*upspinFS)(nil)
+var _ srv.AuthOps = (*upspinFS)(nil)
+
+// options holds the settings of the server given on the command line.
+type options struct {
+	debug     int                      // 9P debug level
+	allow     map[upspin.UserName]bool // if not empty, users allowed to attach after authenticating
+	usersDir  string                   // if set, attaches act as the user named by uname
+	cacheDir  string                   // directory for our caches and temporary files
+	cacheSize int64                    // maximum bytes of blocks cached in cacheDir
+	readOnly  bool                     // if set, the tree may not be changed
+	exports   map[string]*export       // exports table, by name
+}
 
-func newUpspinFS(cfg upspin.Config, debug int) *upspinFS {
+func newUpspinFS(cfg upspin.Config, opts *options) *upspinFS {
 	return &upspinFS{
-		Srv:      srv.Srv{Debuglevel: debug},
-		client:   client.New(cfg),
-		userDirs: map[upspin.UserName]bool{cfg.UserName(): true},
-		fileCache: &fileCache{
-			m: make(map[upspin.PathName]*File),
-		},
+		Srv:      srv.Srv{Debuglevel: opts.debug, Dotu: true, Upool: userPool{}},
+		cfg:      cfg,
+		allow:    opts.allow,
+		usersDir: opts.usersDir,
+		cacheDir: opts.cacheDir,
+		readOnly: opts.readOnly,
+		exports:  opts.exports,
+		owner:    newIdentity(cfg, opts.cacheDir),
+		ids:      make(map[upspin.UserName]*identity),
+		opens:    make(map[upspin.PathName]int),
+		rclose:   make(map[upspin.PathName]*identity),
+		modes:    make(map[upspin.PathName]uint32),
+		locks:    lockTable{locks: make(map[upspin.PathName][]lockRange)},
+		errlog:   newErrorLog(opts.cacheDir),
+		blocks:   newBlockCache(opts.cacheDir, opts.cacheSize),
 	}
 }
 
 func (f *upspinFS) Attach(req *srv.Req) {
+	var a *authState
 	if req.Afid != nil {
-		req.RespondError(srv.Enoauth)
+		a, _ = req.Afid.Aux.(*authState)
+	}
+	fid, err := f.attach(req.Tc.Uname, req.Tc.Aname, a)
+	if err != nil {
+		req.RespondError(err)
 		return
 	}
-	req.Fid.Aux = new(Fid)
-	req.RespondRattach(&rootQid)
+	req.Fid.Aux = fid
+	req.RespondRattach(fid.qid())
 }
 
 func (f *upspinFS) Walk(req *srv.Req) {
 	fid := req.Fid.Aux.(*Fid)
-	tc := req.Tc
 
-	if req.Newfid.Aux == nil {
-		req.Newfid.Aux = new(Fid)
-	}
-	nfid := req.Newfid.Aux.(*Fid)
-	*nfid = *fid
-
-	wqids := make([]go9p.Qid, len(tc.Wname))
-	path := string(fid.path)
-	entry := fid.entry
-	i := 0
-	for ; i < len(tc.Wname); i++ {
-		var p string
-		if path == "" {
-			p = tc.Wname[i]
-		} else {
-			p = path + "/" + tc.Wname[i]
-		}
-		ent, err := f.client.Lookup(upspin.PathName(p), false)
-		if err != nil {
-			if i == 0 {
-				req.RespondError(srv.Enoent)
-				return
-			}
-			break
-		}
-		if path == "" {
-			f.userDirs[upspin.UserName(tc.Wname[i])] = true
-		}
-		wqids[i] = *dir2Qid(ent)
-		path = p
-		entry = ent
+	nfid, wqids, err := f.walk(fid, req.Tc.Wname)
+	if err != nil {
+		req.RespondError(err)
+		return
 	}
-	nfid.path = upspin.PathName(path)
-	nfid.entry = entry
-	req.RespondRwalk(wqids[0:i])
+	req.Newfid.Aux = nfid
+	req.RespondRwalk(wqids)
 }
 
 func (f *upspinFS) Open(req *srv.Req) {
 	fid := req.Fid.Aux.(*Fid)
-	tc := req.Tc
 
-	if fid.path == "" {
-		count := 0
-		for user := range f.userDirs {
-			entry, err := f.client.Lookup(upspin.PathName(user), false)
-			if err != nil {
-				req.RespondError(err)
-			}
-			st := dir2Dir(string(user), entry)
-			b := go9p.PackDir(st, req.Conn.Dotu)
-			fid.dirents = append(fid.dirents, b...)
-			count += len(b)
-			fid.direntends = append(fid.direntends, count)
-		}
-		req.RespondRopen(&rootQid, 0)
+	if err := f.open(fid, req.Tc.Mode); err != nil {
+		req.RespondError(err)
 		return
 	}
-	if fid.entry.IsDir() {
-		dirContents, err := f.client.Glob(string(fid.path) + "/*")
-		if err != nil {
-			req.RespondError(err)
-		}
-		count := 0
-		for _, entry := range dirContents {
-			st := dir2Dir(string(entry.Name), entry)
-			b := go9p.PackDir(st, req.Conn.Dotu)
-			fid.dirents = append(fid.dirents, b...)
-			count += len(b)
-			fid.direntends = append(fid.direntends, count)
-		}
-	} else {
-		var err error
-		switch tc.Mode & 3 {
-		case go9p.OWRITE, go9p.ORDWR:
-			fid.file, err = f.fileCache.Writable(f.client, fid.path, tc.Mode&go9p.OTRUNC != 0)
-		default:
-			fid.file, err = f.client.Open(fid.path)
-		}
-		if err != nil {
-			req.RespondError(err)
-			return
-		}
+	count := 0
+	for _, st := range fid.dirs {
+		b := go9p.PackDir(st, req.Conn.Dotu)
+		fid.dirents = append(fid.dirents, b...)
+		count += len(b)
+		fid.direntends = append(fid.direntends, count)
 	}
-	req.RespondRopen(dir2Qid(fid.entry), 0)
+	req.RespondRopen(fid.qid(), 0)
 }
 
 func (f *upspinFS) Create(req *srv.Req) {
 	fid := req.Fid.Aux.(*Fid)
 	tc := req.Tc
 
-	path := upspin.PathName(string(fid.path) + "/" + tc.Name)
-	if _, err := f.client.Lookup(path, false); err == nil {
-		req.RespondError(srv.Eexist)
-		return
-	}
-	const badPerms = go9p.DMSYMLINK | go9p.DMLINK | go9p.DMNAMEDPIPE | go9p.DMDEVICE
 	var err error
-	var entry *upspin.DirEntry
-	var file upspin.File
-	switch {
-	case tc.Perm&go9p.DMDIR != 0:
-		entry, err = f.client.MakeDirectory(path)
-	case tc.Perm&badPerms != 0:
-		req.RespondError(&go9p.Error{"not implemented", go9p.EIO})
-		return
-	default:
-		// Write an empty file in case Walk happened before file is closed.
-		entry, err = f.client.Put(path, []byte{})
-		if err == nil {
-			file, err = f.fileCache.Writable(f.client, path, true)
-		}
+	if tc.Perm&go9p.DMSYMLINK != 0 {
+		// 9P2000.u gives the link target in the extension.
+		err = f.symlink(fid, tc.Name, tc.Ext)
+	} else {
+		err = f.create(fid, tc.Name, tc.Perm, tc.Mode)
 	}
 	if err != nil {
 		req.RespondError(err)
 		return
 	}
-	fid.path = path
-	fid.entry = entry
-	fid.file = file
-	req.RespondRcreate(dir2Qid(fid.entry), 0)
+	req.RespondRcreate(fid.qid(), 0)
 }
 
 func (f *upspinFS) Read(req *srv.Req) {
@@ -186,7 +151,7 @@ func (f *upspinFS) Read(req *srv.Req) {
 
 	go9p.InitRread(rc, tc.Count)
 	var count int
-	if fid.path == "" || fid.entry.IsDir() {
+	if fid.isDir() {
 		if tc.Count == 0 || len(fid.direntends) == 0 {
 			goto done
 		}
@@ -194,7 +159,8 @@ func (f *upspinFS) Read(req *srv.Req) {
 		if tc.Offset != 0 {
 			i = sort.SearchInts(fid.direntends, int(tc.Offset))
 			if i >= len(fid.direntends) || fid.direntends[i] != int(tc.Offset) {
-				req.RespondError(&go9p.Error{"invalid offset", go9p.EINVAL})
+				req.RespondError(&go9p.Error{Err: "invalid offset", Errornum: go9p.EINVAL})
+				return
 			}
 		}
 		if int(tc.Offset) == fid.direntends[len(fid.direntends)-1] {
@@ -210,14 +176,14 @@ func (f *upspinFS) Read(req *srv.Req) {
 			}
 		}
 		if count <= 0 {
-			req.RespondError(&go9p.Error{"too small read size for dir entry", go9p.EINVAL})
+			req.RespondError(&go9p.Error{Err: "too small read size for dir entry", Errornum: go9p.EINVAL})
 			return
 		}
 		copy(rc.Data, fid.dirents[tc.Offset:int(tc.Offset)+count])
 	} else {
 		var err error
-		count, err = fid.file.ReadAt(rc.Data, int64(tc.Offset))
-		if err != nil && err != io.EOF {
+		count, err = f.read(fid, rc.Data, int64(tc.Offset))
+		if err != nil {
 			req.RespondError(err)
 			return
 		}
@@ -231,7 +197,7 @@ func (f *upspinFS) Write(req *srv.Req) {
 	fid := req.Fid.Aux.(*Fid)
 	tc := req.Tc
 
-	n, err := fid.file.WriteAt(tc.Data, int64(tc.Offset))
+	n, err := f.write(fid, tc.Data, int64(tc.Offset))
 	if err != nil {
 		req.RespondError(err)
 		return
@@ -240,12 +206,23 @@ func (f *upspinFS) Write(req *srv.Req) {
 }
 
 func (f *upspinFS) Clunk(req *srv.Req) {
+	// The file is stored before replying, so that a failure to store
+	// it is reported. FidDestroy later finds nothing left to do.
+	if fid, ok := req.Fid.Aux.(*Fid); ok {
+		if err := f.clunk(fid); err != nil {
+			// A Tclunk releases the fid even if it fails, but
+			// go9p releases it only after an Rclunk.
+			req.Fid.DecRef()
+			req.RespondError(err)
+			return
+		}
+	}
 	req.RespondRclunk()
 }
 
 func (f *upspinFS) Remove(req *srv.Req) {
 	fid := req.Fid.Aux.(*Fid)
-	if err := f.client.Delete(fid.path); err != nil {
+	if err := f.remove(fid); err != nil {
 		req.RespondError(err)
 		return
 	}
@@ -254,57 +231,691 @@ func (f *upspinFS) Remove(req *srv.Req) {
 
 func (f *upspinFS) Stat(req *srv.Req) {
 	fid := req.Fid.Aux.(*Fid)
-	req.RespondRstat(dir2Dir(string(fid.path), fid.entry))
+	req.RespondRstat(f.stat(fid))
 }
 
 func (f *upspinFS) Wstat(req *srv.Req) {
 	fid := req.Fid.Aux.(*Fid)
-	dir := &req.Tc.Dir
 
-	os.Stdout.Sync()
-	if dir.Name != "" {
+	if err := f.wstat(fid, &req.Tc.Dir); err != nil {
+		req.RespondError(err)
+		return
+	}
+	req.RespondRwstat()
+}
+
+func (f *upspinFS) FidDestroy(sfid *srv.Fid) {
+	if fid, ok := sfid.Aux.(*Fid); ok {
+		f.clunk(fid)
+	}
+}
+
+// The methods below implement the file system operations shared by
+// the 9P2000 and 9P2000.L dialects.
+
+// walk walks from fid through the path elements in names. It returns a new
+// Fid for the last element reached and the qids of every element walked.
+// An error is returned only if the first element cannot be walked.
+func (f *upspinFS) walk(fid *Fid, names []string) (*Fid, []go9p.Qid, error) {
+	nfid := fid.clone()
+	wqids := make([]go9p.Qid, len(names))
+	path := fid.path
+	entry := fid.entry
+	i := 0
+	if (fid.synth != nil || fid.effective) && len(names) > 0 {
+		return nil, nil, srv.Enotdir
+	}
+	for ; i < len(names); i++ {
+		if path == "" && !nfid.info {
+			if names[i] == infoRoot {
+				nfid.info = true
+				wqids[i] = infoRootQid
+				continue
+			}
+			if s := lookupSynth(names[i]); s != nil {
+				nfid.synth = s
+				wqids[i] = *s.qid()
+				i++
+				break
+			}
+		}
+		if names[i] == effectiveFile && path != "" && !nfid.info && entry.IsDir() {
+			nfid.effective = true
+			wqids[i] = *effectiveQid(path)
+			i++
+			break
+		}
+		if names[i] != ".." && !validName(names[i]) {
+			if i == 0 {
+				return nil, nil, srv.Enoent
+			}
+			break
+		}
+		p := join(path, names[i])
+		switch names[i] {
+		case "..":
+			if path == "" && nfid.info {
+				nfid.info = false
+				wqids[i] = rootQid
+				continue
+			}
+			if root := snapshotParent(path); root != "" && fid.export == nil {
+				p = root
+				break
+			}
+			p = parent(fid.export, path)
+			if p == "" {
+				wqids[i] = rootQid
+				if nfid.info {
+					wqids[i] = infoRootQid
+				}
+				path, entry = "", nil
+				continue
+			}
+		case snapshotDir:
+			if root := snapshotRoot(path); root != "" {
+				p = root
+			}
+		}
+		ent, err := fid.id.client.Lookup(p, false)
+		if err != nil {
+			if i == 0 {
+				return nil, nil, srv.Enoent
+			}
+			break
+		}
+		if path == "" {
+			fid.id.addUser(upspin.UserName(names[i]))
+		}
+		wqids[i] = *dir2Qid(ent)
+		if nfid.info {
+			wqids[i] = *infoQid(ent)
+		}
+		path = p
+		entry = ent
+	}
+	nfid.path = path
+	nfid.entry = entry
+	return nfid, wqids[0:i], nil
+}
+
+// open prepares fid for I/O. The contents of a directory are read into
+// fid.dirs; files get an upspin.File for reading or writing.
+func (f *upspinFS) open(fid *Fid, mode uint8) error {
+	if mode&go9p.ORCLOSE != 0 && fid.synth == nil {
+		if err := f.checkWritable(fid, fid.path); err != nil {
+			return err
+		}
+	}
+	if err := f.opening(fid); err != nil {
+		return err
+	}
+	if err := f.open1(fid, mode); err != nil {
+		f.omu.Lock()
+		f.closePath(fid)
+		f.omu.Unlock()
+		return err
+	}
+	f.opened(fid, mode)
+	return nil
+}
+
+func (f *upspinFS) open1(fid *Fid, mode uint8) error {
+	if fid.synth != nil {
+		return f.openSynth(fid, mode)
+	}
+	if fid.info {
+		return f.openInfo(fid, mode)
+	}
+	if fid.effective {
+		return f.openEffective(fid, mode)
+	}
+	if fid.path == "" {
+		for _, user := range fid.id.users() {
+			entry, err := fid.id.client.Lookup(upspin.PathName(user), false)
+			if err != nil {
+				return err
+			}
+			fid.dirs = append(fid.dirs, f.dir2Dir(fid.id, string(user), entry))
+		}
+		for _, s := range synthFiles {
+			fid.dirs = append(fid.dirs, f.synthDir(fid.id, s))
+		}
+		fid.dirs = append(fid.dirs, f.infoRootDir(fid.id))
+		return nil
+	}
+	if fid.entry.IsDir() {
+		dirContents, err := fid.id.client.Glob(string(fid.path) + "/*")
+		if err != nil {
+			return err
+		}
+		for _, entry := range dirContents {
+			fid.dirs = append(fid.dirs, f.dir2Dir(fid.id, string(entry.Name), entry))
+		}
+		if d := f.snapshotDirEntry(fid.id, fid.path); d != nil {
+			fid.dirs = append(fid.dirs, d)
+		}
+		fid.dirs = append(fid.dirs, f.effectiveDir(fid.id, fid.entry))
+		return nil
+	}
+	var err error
+	switch mode & 3 {
+	case go9p.OWRITE, go9p.ORDWR:
+		if err := f.checkWritable(fid, fid.path); err != nil {
+			return err
+		}
+		fid.file, err = fid.id.fileCache.Writable(fid.id.client, fid.path, mode&go9p.OTRUNC != 0)
+	default:
+		var entry *upspin.DirEntry
+		entry, err = fid.id.client.Lookup(fid.path, true)
+		if err == nil {
+			fid.file, err = Readable(fid.id.cfg, entry, f.blocks)
+		}
+	}
+	return err
+}
+
+// create creates the file or directory name within the directory fid
+// and changes fid to refer to it.
+func (f *upspinFS) create(fid *Fid, name string, perm uint32, mode uint8) error {
+	if fid.synth != nil || fid.effective {
+		return srv.Enotdir
+	}
+	if !validName(name) {
+		return errBadName
+	}
+	if name == effectiveFile {
+		return srv.Eexist
+	}
+	path := join(fid.path, name)
+	if err := f.checkWritable(fid, path); err != nil {
+		return err
+	}
+	if _, err := fid.id.client.Lookup(path, false); err == nil {
+		return srv.Eexist
+	}
+	const badPerms = go9p.DMSYMLINK | go9p.DMLINK | go9p.DMNAMEDPIPE | go9p.DMDEVICE
+	var err error
+	var entry *upspin.DirEntry
+	var file upspin.File
+	switch {
+	case perm&go9p.DMDIR != 0:
+		entry, err = fid.id.client.MakeDirectory(path)
+	case perm&badPerms != 0:
+		return &go9p.Error{Err: "not implemented", Errornum: go9p.EIO}
+	default:
+		// Write an empty file in case Walk happened before file is closed.
+		// The put fails if the file was made since the Lookup above.
+		entry, err = fid.id.client.PutSequenced(path, upspin.SeqNotExist, []byte{})
+		if errors.Is(errors.Exist, err) {
+			return srv.Eexist
+		}
+		if err == nil {
+			file, err = fid.id.fileCache.Writable(fid.id.client, path, true)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	fid.path = path
+	fid.entry = entry
+	fid.file = file
+	f.setMode(path, perm&serverModes)
+	f.omu.Lock()
+	f.opens[path]++
+	f.omu.Unlock()
+	f.opened(fid, mode)
+	return nil
+}
+
+// read reads from the open file fid at offset off.
+func (f *upspinFS) read(fid *Fid, b []byte, off int64) (int, error) {
+	if fid.synth != nil {
+		return f.readSynth(fid, b, off)
+	}
+	if fid.info || fid.effective {
+		return readData(fid.synthData, b, off), nil
+	}
+	if fid.file == nil {
+		return 0, srv.Ebaduse
+	}
+	n, err := fid.file.ReadAt(b, off)
+	if err == io.EOF {
+		err = nil
+	}
+	return n, err
+}
+
+// write writes to the open file fid at offset off.
+// In append mode the data is written at the end of the file instead.
+func (f *upspinFS) write(fid *Fid, b []byte, off int64) (int, error) {
+	if fid.synth != nil {
+		return f.writeSynth(fid, b)
+	}
+	if fid.file == nil {
+		return 0, srv.Ebaduse
+	}
+	if file, ok := fid.file.(*File); ok && (fid.append || f.mode(fid.path)&go9p.DMAPPEND != 0) {
+		return file.Append(b)
+	}
+	return fid.file.WriteAt(b, off)
+}
+
+var (
+	errWstatMode  = &go9p.Error{Err: "permissions are set by Access files", Errornum: go9p.EPERM}
+	errWstatOwner = &go9p.Error{Err: "owner and group are set by Access files", Errornum: go9p.EPERM}
+
+	errReadOnlyServer = &go9p.Error{Err: "read-only server", Errornum: go9p.EPERM}
+	errBadName        = &go9p.Error{Err: "invalid file name", Errornum: go9p.EINVAL}
+)
+
+// validName reports whether name may name a file within a directory.
+// Names holding a slash, or standing for the directory itself or its
+// parent, would reach other files once cleaned by path.Parse. Walks
+// handle ".." themselves.
+func validName(name string) bool {
+	return name != "" && name != "." && name != ".." && !strings.Contains(name, "/")
+}
+
+// wstat changes the file fid refers to as requested by dir, whose fields
+// hold all ones or the empty string if they are not to be changed. The
+// requested changes are checked before any is made. A wstat changing
+// nothing is a request to sync the file; the access time is ignored.
+func (f *upspinFS) wstat(fid *Fid, dir *go9p.Dir) error {
+	const dontTouch32 = ^uint32(0)
+	const dontTouch64 = ^uint64(0)
+	setLength := dir.Length != dontTouch64
+	setMtime := dir.Mtime != dontTouch32
+	st := f.stat(fid)
+	setName := dir.Name != "" && dir.Name != st.Name
+
+	setMode := dir.Mode != dontTouch32 && dir.Mode != st.Mode
+	if setMode {
+		switch change := dir.Mode ^ st.Mode; {
+		case change&go9p.DMDIR != 0:
+			return srv.Edirchange
+		case change&^serverModes != 0:
+			return errWstatMode
+		}
+	}
+	if dir.Uid != "" && dir.Uid != st.Uid || dir.Gid != "" && dir.Gid != st.Gid {
+		return errWstatOwner
+	}
+	if !setLength && !setMtime && !setName && !setMode {
+		if isNullWstat(dir) {
+			// A wstat touching nothing asks that the file be
+			// committed to stable storage.
+			return f.fsync(fid)
+		}
+		return nil
+	}
+	if fid.synth != nil || fid.path == "" {
+		return srv.Eperm
+	}
+	if err := f.checkWritable(fid, fid.path); err != nil {
+		return err
+	}
+	if setLength && fid.isDir() {
+		return errIsDir
+	}
+	var destpath upspin.PathName
+	if setName {
 		fiddir, _ := path.Split(string(fid.path))
-		destpath := upspin.PathName(dir.Name)
+		destpath = upspin.PathName(dir.Name)
 		if destdir, _ := path.Split(string(dir.Name)); destdir == "" {
 			// filename is relative to source directory
 			destpath = upspin.PathName(path.Join(fiddir, dir.Name))
 		}
-		if _, err := f.client.Lookup(destpath, false); err == nil {
-			req.RespondError(srv.Eexist)
-			return
+		if _, err := fid.id.client.Lookup(destpath, false); err == nil {
+			return srv.Eexist
 		}
-		entry, err := f.client.Rename(fid.path, destpath)
-		if err != nil {
-			req.RespondError(err)
-			return
+	}
+
+	if setMode {
+		f.setMode(fid.path, dir.Mode&serverModes)
+	}
+	if setLength {
+		if err := f.truncate(fid, int64(dir.Length)); err != nil {
+			return err
+		}
+	}
+	if setMtime {
+		if err := f.setTime(fid, upspin.Time(dir.Mtime)); err != nil {
+			return err
 		}
-		fid.path = destpath
-		fid.entry = entry
-		req.RespondRwstat()
-		return
 	}
-	req.RespondError(srv.Enotimpl)
+	if setName {
+		return f.rename(fid, destpath)
+	}
+	return nil
 }
 
-func (f *upspinFS) FidDestroy(sfid *srv.Fid) {
-	if sfid.Aux == nil {
+// truncate changes the length of the file fid refers to.
+func (f *upspinFS) truncate(fid *Fid, size int64) error {
+	if fid.isDir() {
+		return errIsDir
+	}
+	if err := f.checkWritable(fid, fid.path); err != nil {
+		return err
+	}
+	return fid.id.fileCache.Truncate(fid.id.client, fid.path, size)
+}
+
+// setTime sets the modification time of the file fid refers to or, if
+// it is being written, the time it is given once stored. Setting it now
+// would change the file under the writer, which could then not store it.
+func (f *upspinFS) setTime(fid *Fid, t upspin.Time) error {
+	if fid.synth != nil || fid.path == "" {
+		return srv.Eperm
+	}
+	if err := f.checkWritable(fid, fid.path); err != nil {
+		return err
+	}
+	if file := fid.id.fileCache.get(fid.path); file != nil {
+		file.setTime(t)
+		return nil
+	}
+	return fid.id.client.SetTime(fid.path, t)
+}
+
+// isNullWstat reports whether dir leaves every field untouched.
+func isNullWstat(dir *go9p.Dir) bool {
+	const dontTouch32 = ^uint32(0)
+	const dontTouch64 = ^uint64(0)
+	return dir.Mode == dontTouch32 && dir.Atime == dontTouch32 && dir.Mtime == dontTouch32 &&
+		dir.Length == dontTouch64 && dir.Name == "" && dir.Uid == "" && dir.Gid == "" && dir.Muid == ""
+}
+
+// fsync stores the contents of the file fid refers to, if it is being
+// written, leaving it open for further writes.
+func (f *upspinFS) fsync(fid *Fid) error {
+	if fid.synthetic() {
+		return nil
+	}
+	file := fid.id.fileCache.get(fid.path)
+	if file == nil {
+		return nil
+	}
+	if err := file.flush(); err != nil {
+		f.errlog.add(fid.id.cfg.UserName(), fid.path, err)
+		return err
+	}
+	return nil
+}
+
+// stat returns the directory entry of the file fid refers to.
+func (f *upspinFS) stat(fid *Fid) *go9p.Dir {
+	if fid.synth != nil {
+		return f.synthDir(fid.id, fid.synth)
+	}
+	if fid.info {
+		return f.infoStat(fid)
+	}
+	if fid.effective {
+		return f.effectiveDir(fid.id, fid.entry)
+	}
+	return f.dir2Dir(fid.id, string(fid.path), fid.entry)
+}
+
+// dir2Dir is like the method dir2Dir of id but also sets the
+// mode bits kept by the server.
+func (f *upspinFS) dir2Dir(id *identity, name string, d *upspin.DirEntry) *go9p.Dir {
+	dir := id.dir2Dir(name, d)
+	if d != nil {
+		dir.Mode |= f.mode(d.Name)
+		if isSnapshot(d.Name) {
+			dir.Mode &^= 0222
+		}
+	}
+	return dir
+}
+
+// serverModes are the mode bits that Upspin cannot store, which are kept
+// by the server instead. They bind only its own clients and are forgotten
+// when it exits.
+const serverModes = go9p.DMEXCL | go9p.DMAPPEND
+
+var errExclusive = &go9p.Error{Err: "exclusive use file already open", Errornum: eBUSY}
+
+// setMode sets the server's mode bits of name.
+func (f *upspinFS) setMode(name upspin.PathName, mode uint32) {
+	f.omu.Lock()
+	defer f.omu.Unlock()
+	if mode == 0 {
+		delete(f.modes, name)
+	} else {
+		f.modes[name] = mode
+	}
+}
+
+// mode returns the server's mode bits of name.
+func (f *upspinFS) mode(name upspin.PathName) uint32 {
+	f.omu.Lock()
+	defer f.omu.Unlock()
+	return f.modes[name]
+}
+
+// remove removes the file or directory fid refers to.
+func (f *upspinFS) remove(fid *Fid) error {
+	if fid.synth != nil {
+		return srv.Eperm
+	}
+	if err := f.checkWritable(fid, fid.path); err != nil {
+		return err
+	}
+	if err := fid.id.client.Delete(fid.path); err != nil {
+		return err
+	}
+	f.omu.Lock()
+	delete(f.rclose, fid.path)
+	delete(f.modes, fid.path)
+	f.omu.Unlock()
+	return nil
+}
+
+// rename renames the file fid refers to to newpath.
+func (f *upspinFS) rename(fid *Fid, newpath upspin.PathName) error {
+	if fid.synth != nil {
+		return srv.Eperm
+	}
+	if err := f.checkWritable(fid, fid.path); err != nil {
+		return err
+	}
+	if err := f.checkWritable(fid, newpath); err != nil {
+		return err
+	}
+	entry, err := fid.id.client.Rename(fid.path, newpath)
+	if err != nil {
+		return err
+	}
+	f.omu.Lock()
+	if fid.opened {
+		f.closePath(fid)
+		f.opens[newpath]++
+		if fid.orclose {
+			delete(f.rclose, fid.path)
+			f.rclose[newpath] = fid.id
+		}
+	}
+	if mode, ok := f.modes[fid.path]; ok {
+		delete(f.modes, fid.path)
+		f.modes[newpath] = mode
+	}
+	f.omu.Unlock()
+	fid.path = newpath
+	fid.entry = entry
+	return nil
+}
+
+// opening records that fid is about to be opened. It fails if fid refers
+// to an exclusive-use file that is already open.
+func (f *upspinFS) opening(fid *Fid) error {
+	if fid.synthetic() {
+		return nil
+	}
+	f.omu.Lock()
+	defer f.omu.Unlock()
+	if f.modes[fid.path]&go9p.DMEXCL != 0 && f.opens[fid.path] > 0 {
+		return errExclusive
+	}
+	f.opens[fid.path]++
+	return nil
+}
+
+// opened records that fid has been opened with mode.
+func (f *upspinFS) opened(fid *Fid, mode uint8) {
+	fid.opened = true
+	atomic.AddInt64(&f.nopen, 1)
+	if fid.synthetic() {
 		return
 	}
-	fid := sfid.Aux.(*Fid)
-	if fid.file != nil {
-		f.fileCache.Close(fid.file)
+	if mode&go9p.ORCLOSE != 0 {
+		fid.orclose = true
+		if w, ok := fid.file.(*File); ok && w.writable {
+			if err := w.removeOnClose(); err != nil {
+				log.Error.Printf("9upspinfs: %v", err)
+			}
+		}
+		f.omu.Lock()
+		f.rclose[fid.path] = fid.id
+		f.omu.Unlock()
+	}
+}
+
+// closePath records that fid is no longer open. If it was the last fid
+// open on its file and the file is to be removed on close, it returns the
+// identity that is to remove it. f.omu must be held.
+func (f *upspinFS) closePath(fid *Fid) *identity {
+	if fid.synthetic() {
+		return nil
+	}
+	name := fid.path
+	f.opens[name]--
+	if f.opens[name] > 0 {
+		return nil
+	}
+	delete(f.opens, name)
+	id := f.rclose[name]
+	delete(f.rclose, name)
+	return id
+}
+
+// clunk releases the resources held by fid once it is no longer in use.
+// Once no fid has open a file opened with ORCLOSE, the file is removed
+// and whatever was written to it is discarded.
+func (f *upspinFS) clunk(fid *Fid) error {
+	var rm *identity
+	if fid.opened {
+		fid.opened = false
+		atomic.AddInt64(&f.nopen, -1)
+		f.omu.Lock()
+		rm = f.closePath(fid)
+		f.omu.Unlock()
+	}
+	file := fid.file
+	fid.file = nil
+	if rm == nil {
+		if file != nil {
+			return f.closeFile(fid.id, file)
+		}
+		return nil
+	}
+	discarded := rm.fileCache.discard(fid.path)
+	if file != nil && file != upspin.File(discarded) {
+		fid.id.fileCache.Close(file)
+	}
+	if err := rm.client.Delete(fid.path); err != nil {
+		log.Debug.Printf("9upspinfs: remove on close of %s: %v", fid.path, err)
+		return nil
+	}
+	f.setMode(fid.path, 0)
+	return nil
+}
+
+// closeFile closes file, opened by id. If it was being written and
+// cannot be stored, the failure is recorded in the error log.
+func (f *upspinFS) closeFile(id *identity, file upspin.File) error {
+	err := id.fileCache.Close(file)
+	if err == nil {
+		return nil
+	}
+	if w, ok := file.(*File); ok && w.writable {
+		f.errlog.add(id.cfg.UserName(), file.Name(), err)
 	}
-	// TODO: delete file if ORCLOSE create mode?
+	return err
 }
 
 type Fid struct {
-	path  upspin.PathName
-	entry *upspin.DirEntry
+	id        *identity // Upspin user the fid acts as
+	path      upspin.PathName
+	entry     *upspin.DirEntry
+	uid       uint32     // numeric user id given in a 9P2000.L attach
+	export    *export    // export attached to, or nil for the whole tree
+	synth     *synthFile // set if the fid refers to a synthetic file at the root
+	info      bool       // set if the fid is in the info tree
+	effective bool       // set if the fid refers to the Access.effective file of directory path
 
 	// Initialized in Open or Create
+	opened     bool
+	orclose    bool // opened with ORCLOSE
+	append     bool // opened for appending
 	file       upspin.File
+	dirs       []*go9p.Dir
 	dirents    []byte
 	direntends []int
+	synthData  []byte // contents of a synthetic file
+}
+
+// clone returns an unopened copy of fid.
+func (fid *Fid) clone() *Fid {
+	return &Fid{
+		id:        fid.id,
+		path:      fid.path,
+		entry:     fid.entry,
+		uid:       fid.uid,
+		export:    fid.export,
+		synth:     fid.synth,
+		info:      fid.info,
+		effective: fid.effective,
+	}
+}
+
+func (fid *Fid) isDir() bool {
+	return fid.synth == nil && !fid.effective && (fid.path == "" || fid.entry.IsDir())
+}
+
+// synthetic reports whether fid refers to a file served by 9upspinfs
+// itself rather than stored in Upspin.
+func (fid *Fid) synthetic() bool {
+	return fid.synth != nil || fid.info || fid.effective || fid.path == ""
+}
+
+func (fid *Fid) qid() *go9p.Qid {
+	if fid.synth != nil {
+		return fid.synth.qid()
+	}
+	if fid.effective {
+		return effectiveQid(fid.path)
+	}
+	if fid.info {
+		if fid.path == "" {
+			return &infoRootQid
+		}
+		return infoQid(fid.entry)
+	}
+	if fid.path == "" {
+		return &rootQid
+	}
+	return dir2Qid(fid.entry)
+}
+
+// join returns the path name of the element name within directory dir.
+// The empty dir is the synthetic root holding the user directories.
+func join(dir upspin.PathName, name string) upspin.PathName {
+	if dir == "" {
+		return upspin.PathName(name)
+	}
+	return dir + "/" + upspin.PathName(name)
 }
 
 func dir2Dir(path string, d *upspin.DirEntry) *go9p.Dir {
@@ -312,6 +923,9 @@ func dir2Dir(path string, d *upspin.DirEntry) *go9p.Dir {
 	dir.Uid = "augie"
 	dir.Gid = "augie"
 	dir.Mode = 0700
+	dir.Uidnum = go9p.NOUID
+	dir.Gidnum = go9p.NOUID
+	dir.Muidnum = go9p.NOUID
 
 	if path == "" {
 		dir.Qid = rootQid
@@ -328,6 +942,11 @@ func dir2Dir(path string, d *upspin.DirEntry) *go9p.Dir {
 	dir.Mtime = uint32(d.Time)
 	sz, _ := d.Size()
 	dir.Length = uint64(sz)
+	if d.IsLink() {
+		dir.Mode |= go9p.DMSYMLINK
+		dir.Ext = linkTarget(d)
+		dir.Length = uint64(len(dir.Ext))
+	}
 	dir.Name = path[strings.LastIndex(path, "/")+1:]
 	return dir
 }
@@ -353,6 +972,9 @@ func dir2Qid(d *upspin.DirEntry) *go9p.Qid {
 	if d.IsDir() {
 		typ |= go9p.QTDIR
 	}
+	if d.IsLink() {
+		typ |= go9p.QTSYMLINK
+	}
 	return &go9p.Qid{
 		Path:    qidpath(d.Name),
 		Version: uint32(d.Sequence),
@@ -366,8 +988,9 @@ var rootQid = go9p.Qid{
 	Type:    go9p.QTDIR,
 }
 
-func do(cfg upspin.Config, net, addr string, debug int) {
-	srv := newUpspinFS(cfg, debug)
+func do(cfg upspin.Config, net, addr string, opts *options) {
+	srv := newUpspinFS(cfg, opts)
+	srv.recoverJournals()
 	if !srv.Start(srv) {
 		log.Debug.Fatal("Srv start failed")
 	}
@@ -388,7 +1011,7 @@ func do(cfg upspin.Config, net, addr string, debug int) {
 			addr = plan9.Namespace() + "/" + addr
 		}
 	}
-	if err := srv.StartNetListener(net, addr); err != nil {
+	if err := srv.listen(net, addr); err != nil {
 		log.Debug.Fatal(err)
 	}
 }
@@ -396,7 +1019,10 @@ func do(cfg upspin.Config, net, addr string, debug int) {
 // FileCache stores a mapping of path name to the open file used for writing.
 // This is used to implement concurrent writes.
 type fileCache struct {
-	m map[upspin.PathName]*File
+	m       map[upspin.PathName]*File
+	cfg     upspin.Config // config of the client writing the files
+	dir     string        // directory for the contents of large files
+	journal bool          // keep the contents of changed files in dir
 	sync.Mutex
 }
 
@@ -407,7 +1033,7 @@ func (fc *fileCache) Writable(client upspin.Client, name upspin.PathName, trunca
 	if ok {
 		return file, nil
 	}
-	file, err := Writable(client, name, truncate)
+	file, err := Writable(fc.cfg, client, name, truncate, fc.dir, fc.journal)
 	if err != nil {
 		return nil, err
 	}
@@ -415,6 +1041,55 @@ func (fc *fileCache) Writable(client upspin.Client, name upspin.PathName, trunca
 	return file, nil
 }
 
+// get returns the file name if it is being written, or nil.
+func (fc *fileCache) get(name upspin.PathName) *File {
+	fc.Lock()
+	defer fc.Unlock()
+	return fc.m[name]
+}
+
+// Truncate changes the size of the file name. If the file is being
+// written, the change is stored with it; otherwise it is stored now.
+func (fc *fileCache) Truncate(client upspin.Client, name upspin.PathName, size int64) error {
+	if file := fc.get(name); file != nil {
+		return file.Truncate(size)
+	}
+	file, err := Writable(fc.cfg, client, name, size == 0, fc.dir, fc.journal)
+	if err != nil {
+		return err
+	}
+	if err := file.Truncate(size); err != nil {
+		file.release()
+		return err
+	}
+	return file.Close()
+}
+
+// discard forgets the file name being written, if any, without storing
+// it. It returns the discarded file.
+func (fc *fileCache) discard(name upspin.PathName) *File {
+	fc.Lock()
+	defer fc.Unlock()
+	file, ok := fc.m[name]
+	if !ok {
+		return nil
+	}
+	delete(fc.m, name)
+	file.discard()
+	return file
+}
+
+// files returns the files being written.
+func (fc *fileCache) files() []*File {
+	fc.Lock()
+	defer fc.Unlock()
+	files := make([]*File, 0, len(fc.m))
+	for _, file := range fc.m {
+		files = append(files, file)
+	}
+	return files
+}
+
 func (fc *fileCache) Close(file upspin.File) error {
 	fc.Lock()
 	defer fc.Unlock()
@@ -425,7 +1100,10 @@ func (fc *fileCache) Close(file upspin.File) error {
 		// Some possibilities:
 		// (1) The file was not opened for writing.
 		// (2) The file is already closed by a Tcluck of some other fid
-		//	that pointed to the same file.
+		//	that pointed to the same file, which reported any error.
+		if w, ok := file.(*File); ok && w.writable {
+			return nil
+		}
 		return file.Close()
 	}
 	err := file.Close()
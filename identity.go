@@ -0,0 +1,120 @@
+// Copyright 2018 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"upspin.io/client"
+	"upspin.io/config"
+	"upspin.io/errors"
+	"upspin.io/log"
+	"upspin.io/upspin"
+	"upspin.io/user"
+)
+
+// identity is an Upspin user on whose behalf 9P requests are made.
+// Each identity has its own client and its own set of files being
+// written, so that writes are always signed by the user making them.
+// Its caches are also its own, since what can be seen depends on the user.
+type identity struct {
+	cfg         upspin.Config
+	client      *cachingClient
+	fileCache   *fileCache
+	accessCache accessCache
+
+	mu       sync.Mutex // protects userDirs
+	userDirs map[upspin.UserName]bool
+}
+
+func newIdentity(cfg upspin.Config, cacheDir string) *identity {
+	return &identity{
+		cfg:    cfg,
+		client: newCachingClient(client.New(cfg)),
+		fileCache: &fileCache{
+			m:       make(map[upspin.PathName]*File),
+			cfg:     cfg,
+			dir:     spillDir(cacheDir),
+			journal: cacheDir != "",
+		},
+		accessCache: accessCache{
+			which:  make(map[upspin.PathName]whichAccess),
+			parsed: make(map[upspin.PathName]parsedAccess),
+		},
+		userDirs: map[upspin.UserName]bool{cfg.UserName(): true},
+	}
+}
+
+// identity returns the identity used by an attach of the 9P user uname.
+// Unless a users directory is configured, everyone acts as the user
+// of the server's config. Otherwise the config is read from
+// <usersDir>/<uname>/config on the first attach of each user.
+func (f *upspinFS) identity(uname string) (*identity, error) {
+	const op errors.Op = "9upspinfs.identity"
+	if f.usersDir == "" {
+		return f.owner, nil
+	}
+	u, err := user.Clean(upspin.UserName(uname))
+	if err != nil {
+		return nil, errors.E(op, errors.Invalid, err)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if id, ok := f.ids[u]; ok {
+		return id, nil
+	}
+	file := filepath.Join(f.usersDir, string(u), "config")
+	cfg, err := config.FromFile(file)
+	if err != nil {
+		return nil, errors.E(op, u, errors.Permission, err)
+	}
+	if cfg.UserName() != u {
+		return nil, errors.E(op, u, errors.Permission, errors.Errorf("%s is for user %s", file, cfg.UserName()))
+	}
+	log.Info.Printf("9upspinfs: serving %s using %s", u, file)
+	id := newIdentity(cfg, f.cacheDir)
+	f.ids[u] = id
+	return id, nil
+}
+
+// identities returns the identities in use, sorted by user name.
+func (f *upspinFS) identities() []*identity {
+	f.mu.Lock()
+	ids := []*identity{f.owner}
+	for _, id := range f.ids {
+		if id != f.owner {
+			ids = append(ids, id)
+		}
+	}
+	for _, e := range f.exports {
+		for _, id := range e.ids {
+			ids = append(ids, id)
+		}
+	}
+	f.mu.Unlock()
+	sort.Slice(ids, func(i, j int) bool { return ids[i].cfg.UserName() < ids[j].cfg.UserName() })
+	return ids
+}
+
+// users returns the user directories shown at the root.
+func (id *identity) users() []upspin.UserName {
+	id.mu.Lock()
+	defer id.mu.Unlock()
+	users := make([]upspin.UserName, 0, len(id.userDirs))
+	for u := range id.userDirs {
+		users = append(users, u)
+	}
+	return users
+}
+
+// addUser adds user to the user directories shown at the root.
+func (id *identity) addUser(u upspin.UserName) {
+	id.mu.Lock()
+	id.userDirs[u] = true
+	id.mu.Unlock()
+}
@@ -0,0 +1,183 @@
+// Copyright 2018 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// This file implements the synthetic tree /.info, which mirrors the
+// Upspin tree for clients without extended attributes. Directories
+// appear as directories, and reading any other file in the tree yields
+// a description of its directory entry, as printed by upspin info.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"time"
+
+	"upspin.io/access"
+	"upspin.io/upspin"
+
+	go9p "github.com/lionkov/go9p/p"
+	"github.com/lionkov/go9p/p/srv"
+)
+
+// infoRoot is the name of the info tree at the root.
+const infoRoot = ".info"
+
+var infoRootQid = go9p.Qid{
+	Path: qidpath(upspin.PathName("/" + infoRoot)),
+	Type: go9p.QTDIR,
+}
+
+// infoQid returns the qid of the entry d within the info tree,
+// which differs from that of d itself.
+func infoQid(d *upspin.DirEntry) *go9p.Qid {
+	qid := &go9p.Qid{
+		Path:    qidpath("/" + infoRoot + "/" + d.Name),
+		Version: uint32(d.Sequence),
+	}
+	if d.IsDir() {
+		qid.Type = go9p.QTDIR
+	}
+	return qid
+}
+
+// infoRootDir returns the directory entry of the root of the info tree.
+func (f *upspinFS) infoRootDir(id *identity) *go9p.Dir {
+	now := uint32(time.Now().Unix())
+	return &go9p.Dir{
+		Qid:     infoRootQid,
+		Mode:    go9p.DMDIR | 0555,
+		Atime:   now,
+		Mtime:   now,
+		Name:    infoRoot,
+		Uid:     string(id.cfg.UserName()),
+		Gid:     string(id.cfg.UserName()),
+		Muid:    string(id.cfg.UserName()),
+		Uidnum:  go9p.NOUID,
+		Gidnum:  go9p.NOUID,
+		Muidnum: go9p.NOUID,
+	}
+}
+
+// infoDir returns the directory entry of the entry d within the info tree.
+// Its files are read-only and have no length, since their contents are
+// produced when they are opened.
+func (f *upspinFS) infoDir(id *identity, name string, d *upspin.DirEntry) *go9p.Dir {
+	dir := f.dir2Dir(id, name, d)
+	dir.Qid = *infoQid(d)
+	dir.Mode &^= 0222 | go9p.DMSYMLINK | serverModes
+	if !d.IsDir() {
+		dir.Length = 0
+		dir.Ext = ""
+	}
+	return dir
+}
+
+// infoStat returns the directory entry of the file fid refers to,
+// which is in the info tree.
+func (f *upspinFS) infoStat(fid *Fid) *go9p.Dir {
+	if fid.path == "" {
+		return f.infoRootDir(fid.id)
+	}
+	return f.infoDir(fid.id, string(fid.path), fid.entry)
+}
+
+// openInfo opens fid, which is in the info tree. Like the directories
+// of the Upspin tree, the contents of its files are read when opened.
+func (f *upspinFS) openInfo(fid *Fid, mode uint8) error {
+	if mode&3 != go9p.OREAD {
+		return srv.Eperm
+	}
+	if fid.path == "" {
+		for _, user := range fid.id.users() {
+			entry, err := fid.id.client.Lookup(upspin.PathName(user), false)
+			if err != nil {
+				return err
+			}
+			fid.dirs = append(fid.dirs, f.infoDir(fid.id, string(user), entry))
+		}
+		return nil
+	}
+	if fid.entry.IsDir() {
+		dirContents, err := fid.id.client.Glob(string(fid.path) + "/*")
+		if err != nil {
+			return err
+		}
+		for _, entry := range dirContents {
+			fid.dirs = append(fid.dirs, f.infoDir(fid.id, string(entry.Name), entry))
+		}
+		return nil
+	}
+	entry, err := fid.id.client.Lookup(fid.path, false)
+	if err != nil {
+		return err
+	}
+	fid.synthData = infoText(fid.id, entry)
+	return nil
+}
+
+// infoText returns the description of the entry d read by id.
+func infoText(id *identity, d *upspin.DirEntry) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "%s\n", d.Name)
+	if d.SignedName != d.Name {
+		fmt.Fprintf(&b, "\tsigned name: %s\n", d.SignedName)
+	}
+	fmt.Fprintf(&b, "\tpacking: %s\n", d.Packing)
+	if size, err := d.Size(); err == nil {
+		fmt.Fprintf(&b, "\tsize: %d\n", size)
+	}
+	fmt.Fprintf(&b, "\ttime: %s\n", d.Time)
+	fmt.Fprintf(&b, "\twriter: %s\n", d.Writer)
+	fmt.Fprintf(&b, "\tsequence: %d\n", d.Sequence)
+	fmt.Fprintf(&b, "\tattributes: %s\n", attrString(d))
+	if d.IsLink() {
+		fmt.Fprintf(&b, "\tlink: %s\n", d.Link)
+	}
+	acc, err := id.access(d)
+	switch {
+	case err != nil:
+		fmt.Fprintf(&b, "\taccess file: %v\n", err)
+	case acc == nil:
+		u, _ := defaultUser(d.Name)
+		fmt.Fprintf(&b, "\taccess file: none\n")
+		fmt.Fprintf(&b, "\treaders: %s\n", u)
+	default:
+		fmt.Fprintf(&b, "\taccess file: %s\n", acc.Path())
+		readers, err := acc.Users(access.Read, id.client.Get)
+		if err != nil {
+			fmt.Fprintf(&b, "\treaders: %v\n", err)
+			break
+		}
+		names := make([]string, len(readers))
+		for i, u := range readers {
+			names[i] = string(u)
+		}
+		fmt.Fprintf(&b, "\treaders: %s\n", strings.Join(names, " "))
+	}
+	for i, block := range d.Blocks {
+		fmt.Fprintf(&b, "\tblock %d: offset %d size %d location %s %s\n",
+			i, block.Offset, block.Size, block.Location.Endpoint, block.Location.Reference)
+	}
+	return b.Bytes()
+}
+
+// attrString returns a description of the attributes of d.
+func attrString(d *upspin.DirEntry) string {
+	var attrs []string
+	if d.IsDir() {
+		attrs = append(attrs, "directory")
+	}
+	if d.IsLink() {
+		attrs = append(attrs, "link")
+	}
+	if d.IsIncomplete() {
+		attrs = append(attrs, "incomplete")
+	}
+	if len(attrs) == 0 {
+		return "none"
+	}
+	return strings.Join(attrs, " ")
+}
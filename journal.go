@@ -0,0 +1,287 @@
+// Copyright 2018 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// This file implements the journal of the files being written, which
+// keeps their contents on disk as they are written, so that they are
+// not lost if the server dies before storing them. The contents of each
+// file are kept in a spill file, next to an index naming the user writing
+// it, its Upspin path, the sequence its contents are based on, its
+// packing and whether it is to be removed once closed. Files left in the
+// journal are stored when the server starts.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"upspin.io/client"
+	"upspin.io/config"
+	"upspin.io/errors"
+	"upspin.io/log"
+	"upspin.io/pack"
+	"upspin.io/upspin"
+)
+
+// journalIndexSuffix is appended to the name of a spill file
+// to give the name of its index.
+const journalIndexSuffix = ".index"
+
+// spillDir returns the directory under cacheDir holding the contents
+// of files being written, or, if cacheDir is empty, the empty string,
+// which stands for the default directory for temporary files.
+func spillDir(cacheDir string) string {
+	if cacheDir == "" {
+		return ""
+	}
+	return filepath.Join(cacheDir, "9upspinfs", "spill")
+}
+
+// journalIndex describes journaled contents.
+type journalIndex struct {
+	user    upspin.UserName
+	name    upspin.PathName
+	seq     int64
+	packing upspin.Packing
+	orclose bool // removed once closed, so not to be stored
+}
+
+// marshal returns the index as text, one field per line.
+func (x *journalIndex) marshal() []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "user %s\n", x.user)
+	fmt.Fprintf(&b, "name %s\n", x.name)
+	fmt.Fprintf(&b, "sequence %d\n", x.seq)
+	fmt.Fprintf(&b, "packing %s\n", x.packing)
+	fmt.Fprintf(&b, "orclose %t\n", x.orclose)
+	return b.Bytes()
+}
+
+// parseJournalIndex parses an index written by marshal.
+func parseJournalIndex(data []byte) (*journalIndex, error) {
+	x := new(journalIndex)
+	var seen int
+	for _, line := range strings.Split(string(data), "\n") {
+		if line == "" {
+			continue
+		}
+		f := strings.SplitN(line, " ", 2)
+		if len(f) != 2 {
+			return nil, errors.Errorf("bad line %q", line)
+		}
+		switch f[0] {
+		case "user":
+			x.user = upspin.UserName(f[1])
+		case "name":
+			x.name = upspin.PathName(f[1])
+		case "sequence":
+			seq, err := strconv.ParseInt(f[1], 10, 64)
+			if err != nil {
+				return nil, errors.Errorf("bad sequence %q", f[1])
+			}
+			x.seq = seq
+		case "packing":
+			p := pack.LookupByName(f[1])
+			if p == nil {
+				return nil, errors.Errorf("unknown packing %q", f[1])
+			}
+			x.packing = p.Packing()
+		case "orclose":
+			orclose, err := strconv.ParseBool(f[1])
+			if err != nil {
+				return nil, errors.Errorf("bad orclose %q", f[1])
+			}
+			x.orclose = orclose
+		default:
+			return nil, errors.Errorf("bad line %q", line)
+		}
+		seen++
+	}
+	if seen != 5 {
+		return nil, errors.Errorf("incomplete index")
+	}
+	return x, nil
+}
+
+// startJournal journals the contents of the file, if it is to be
+// journaled, before their first change. f.mu must be held.
+func (f *File) startJournal(op errors.Op) error {
+	if !f.journal || f.index != "" {
+		return nil
+	}
+	if f.spill == nil {
+		if err := f.spillData(op); err != nil {
+			return err
+		}
+	}
+	f.index = f.spill.Name() + journalIndexSuffix
+	if err := f.writeIndex(op); err != nil {
+		f.index = ""
+		return err
+	}
+	return nil
+}
+
+// writeIndex replaces the index of the journaled contents of the file.
+// f.mu must be held.
+func (f *File) writeIndex(op errors.Op) error {
+	x := &journalIndex{
+		user:    f.config.UserName(),
+		name:    f.target,
+		seq:     f.seq,
+		packing: f.config.Packing(),
+		orclose: f.orclose,
+	}
+	tmp := f.index + ".tmp"
+	if err := ioutil.WriteFile(tmp, x.marshal(), 0600); err != nil {
+		os.Remove(tmp)
+		return errors.E(op, errors.IO, f.name, err)
+	}
+	if err := os.Rename(tmp, f.index); err != nil {
+		os.Remove(tmp)
+		return errors.E(op, errors.IO, f.name, err)
+	}
+	return nil
+}
+
+// removeOnClose records that the file is to be removed once closed,
+// so that its journaled contents are not stored should the server die.
+func (f *File) removeOnClose() error {
+	const op errors.Op = "file.removeOnClose"
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.orclose = true
+	if f.index == "" {
+		return nil
+	}
+	return f.writeIndex(op)
+}
+
+// recoverJournals stores the files that were being written when an
+// earlier run of the server died, reporting them in the log. The files
+// of users the server cannot act as, and every file if the server is
+// read-only, are left for a later run. Other leftovers in the spill
+// directory, such as contents never journaled, are removed.
+func (f *upspinFS) recoverJournals() {
+	if f.cacheDir == "" || f.readOnly {
+		return
+	}
+	names, err := filepath.Glob(filepath.Join(spillDir(f.cacheDir), "*"))
+	if err != nil {
+		log.Error.Printf("9upspinfs: journal: %v", err)
+		return
+	}
+	keep := make(map[string]bool)
+	for _, name := range names {
+		if strings.HasSuffix(name, journalIndexSuffix) && !f.recoverJournal(name) {
+			keep[name] = true
+			keep[strings.TrimSuffix(name, journalIndexSuffix)] = true
+		}
+	}
+	for _, name := range names {
+		if !keep[name] {
+			os.Remove(name)
+		}
+	}
+}
+
+// recoverJournal stores the file whose journaled contents are described
+// by index. It reports whether the journal is done with: it is kept, for
+// a later run, if the file could not be stored.
+func (f *upspinFS) recoverJournal(index string) bool {
+	data, err := ioutil.ReadFile(index)
+	if err != nil {
+		log.Error.Printf("9upspinfs: journal: %v", err)
+		return true
+	}
+	x, err := parseJournalIndex(data)
+	if err != nil {
+		log.Error.Printf("9upspinfs: journal %s: %v", index, err)
+		return true
+	}
+	if x.orclose {
+		log.Info.Printf("9upspinfs: journal: dropped %s, written by %s to be removed once closed", x.name, x.user)
+		return true
+	}
+	if err := f.journalWritable(x.name); err != nil {
+		log.Error.Printf("9upspinfs: journal: cannot store %s for %s: %v", x.name, x.user, err)
+		f.errlog.add(x.user, x.name, err)
+		return true
+	}
+	id, err := f.journalIdentity(x.user)
+	if err != nil {
+		log.Error.Printf("9upspinfs: journal: cannot store %s for %s: %v", x.name, x.user, err)
+		return false
+	}
+	spill, err := os.OpenFile(strings.TrimSuffix(index, journalIndexSuffix), os.O_RDWR, 0)
+	if err != nil {
+		log.Error.Printf("9upspinfs: journal %s: %v", index, err)
+		return true
+	}
+	fi, err := spill.Stat()
+	if err != nil {
+		spill.Close()
+		log.Error.Printf("9upspinfs: journal %s: %v", index, err)
+		return true
+	}
+	cfg, c := id.cfg, upspin.Client(id.client)
+	if x.packing != cfg.Packing() {
+		// The file was written through an export with its own packing.
+		cfg = config.SetPacking(cfg, x.packing)
+		c = client.New(cfg)
+	}
+	file := &File{
+		config:   cfg,
+		client:   c,
+		name:     x.name,
+		target:   x.name,
+		writable: true,
+		size:     fi.Size(),
+		spill:    spill,
+		seq:      x.seq,
+		index:    index,
+	}
+	if err := file.Close(); err != nil {
+		log.Error.Printf("9upspinfs: journal: storing %s for %s: %v", x.name, x.user, err)
+		f.errlog.add(x.user, x.name, err)
+		return false
+	}
+	log.Info.Printf("9upspinfs: journal: recovered %s, %d bytes written by %s", x.name, fi.Size(), x.user)
+	return true
+}
+
+// journalWritable returns an error if name may not be changed by
+// any client of the server. If there is an exports table, only the
+// exports it names may be attached to, so name must lie within one
+// that is not read-only.
+func (f *upspinFS) journalWritable(name upspin.PathName) error {
+	if err := f.checkWritableName(name); err != nil {
+		return err
+	}
+	if len(f.exports) == 0 {
+		return nil
+	}
+	for _, e := range f.exports {
+		if !e.readOnly && within(name, e.root) {
+			return nil
+		}
+	}
+	return errReadOnlyServer
+}
+
+// journalIdentity returns the identity acting as user u.
+func (f *upspinFS) journalIdentity(u upspin.UserName) (*identity, error) {
+	if u == f.cfg.UserName() {
+		return f.owner, nil
+	}
+	if f.usersDir == "" {
+		return nil, errors.Errorf("no config for %s", u)
+	}
+	return f.identity(string(u))
+}
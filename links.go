@@ -0,0 +1,128 @@
+// Copyright 2018 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"strings"
+
+	"upspin.io/errors"
+	"upspin.io/path"
+	"upspin.io/upspin"
+
+	go9p "github.com/lionkov/go9p/p"
+	"github.com/lionkov/go9p/p/srv"
+)
+
+// Upspin links are served as symbolic links. Their targets are Upspin
+// path names, which are turned into paths relative to the directory
+// holding the link, so that the kernel of a client finds them under the
+// synthetic root however the tree is mounted.
+
+var errBadLink = &go9p.Error{Err: "link target outside the tree", Errornum: go9p.EINVAL}
+
+// linkTarget returns the target of the link entry d relative to the
+// directory holding d.
+func linkTarget(d *upspin.DirEntry) string {
+	from, err := path.Parse(d.Name)
+	if err != nil {
+		return string(d.Link)
+	}
+	to, err := path.Parse(d.Link)
+	if err != nil {
+		return string(d.Link)
+	}
+	fromElems := elems(from.Drop(1))
+	toElems := elems(to)
+	i := 0
+	for i < len(fromElems) && i < len(toElems) && fromElems[i] == toElems[i] {
+		i++
+	}
+	var rel []string
+	for range fromElems[i:] {
+		rel = append(rel, "..")
+	}
+	rel = append(rel, toElems[i:]...)
+	if len(rel) == 0 {
+		return "."
+	}
+	return strings.Join(rel, "/")
+}
+
+// resolveLink returns the Upspin path name of target, a path relative to
+// the directory holding the link name, or an error if target leaves the
+// tree.
+func resolveLink(name upspin.PathName, target string) (upspin.PathName, error) {
+	p, err := path.Parse(name)
+	if err != nil {
+		return "", err
+	}
+	if target == "" || strings.HasPrefix(target, "/") {
+		return "", errBadLink
+	}
+	e := elems(p.Drop(1))
+	for _, elem := range strings.Split(target, "/") {
+		switch elem {
+		case "", ".":
+		case "..":
+			if len(e) == 0 {
+				return "", errBadLink
+			}
+			e = e[:len(e)-1]
+		default:
+			e = append(e, elem)
+		}
+	}
+	if len(e) == 0 {
+		return "", errBadLink
+	}
+	return upspin.PathName(e[0] + "/" + strings.Join(e[1:], "/")), nil
+}
+
+// elems returns the user name and path elements of p.
+func elems(p path.Parsed) []string {
+	e := []string{string(p.User())}
+	for i := 0; i < p.NElem(); i++ {
+		e = append(e, p.Elem(i))
+	}
+	return e
+}
+
+// symlink creates the link name within the directory fid, pointing to
+// target, and changes fid to refer to it.
+func (f *upspinFS) symlink(fid *Fid, name, target string) error {
+	const op errors.Op = "9upspinfs.symlink"
+	if fid.synth != nil {
+		return srv.Enotdir
+	}
+	if !validName(name) {
+		return errBadName
+	}
+	path := join(fid.path, name)
+	if err := f.checkWritable(fid, path); err != nil {
+		return err
+	}
+	if _, err := fid.id.client.Lookup(path, false); err == nil {
+		return srv.Eexist
+	}
+	old, err := resolveLink(path, target)
+	if err != nil {
+		return err
+	}
+	entry, err := fid.id.client.PutLink(old, path)
+	if err != nil {
+		return errors.E(op, err)
+	}
+	fid.path = path
+	fid.entry = entry
+	return nil
+}
+
+// readlink returns the target of the link fid refers to.
+func (f *upspinFS) readlink(fid *Fid) (string, error) {
+	if fid.entry == nil || !fid.entry.IsLink() {
+		return "", &go9p.Error{Err: "not a link", Errornum: go9p.EINVAL}
+	}
+	return linkTarget(fid.entry), nil
+}
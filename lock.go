@@ -0,0 +1,205 @@
+// Copyright 2018 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// This file implements the advisory byte-range locks of 9P2000.L.
+// Upspin knows nothing of locks, so they are kept in the server: they
+// are seen by all clients of one server, but not by other servers, and
+// are forgotten when the server exits.
+
+package main
+
+import (
+	"sync"
+
+	"upspin.io/upspin"
+)
+
+// Lock types and statuses of Tlock and Tgetlock.
+const (
+	lockRead   = 0
+	lockWrite  = 1
+	lockUnlock = 2
+
+	lockSuccess = 0
+	lockBlocked = 1
+	lockError   = 2
+)
+
+// lockOwner identifies the holder of a lock: a process
+// of a client on a 9P2000.L connection.
+type lockOwner struct {
+	conn   *dotlConn
+	proc   uint32
+	client string
+}
+
+// lockRange is a lock held on the bytes start up to but not including end.
+type lockRange struct {
+	typ        uint8
+	start, end uint64
+	owner      lockOwner
+}
+
+func (l *lockRange) overlaps(start, end uint64) bool {
+	return l.start < end && start < l.end
+}
+
+// lockTable holds the byte-range locks of each path.
+type lockTable struct {
+	mu    sync.Mutex
+	locks map[upspin.PathName][]lockRange
+}
+
+// lockEnd returns the end of the range of length bytes at start,
+// where a length of zero means up to the end of the file.
+func lockEnd(start, length uint64) uint64 {
+	if length == 0 || start+length < start {
+		return ^uint64(0)
+	}
+	return start + length
+}
+
+// conflict returns a lock on name held by another owner that prevents
+// owner from taking a lock of type typ on the range start to end.
+// lt.mu must be held.
+func (lt *lockTable) conflict(name upspin.PathName, typ uint8, start, end uint64, owner lockOwner) *lockRange {
+	for i, l := range lt.locks[name] {
+		if l.owner != owner && l.overlaps(start, end) && (typ == lockWrite || l.typ == lockWrite) {
+			return &lt.locks[name][i]
+		}
+	}
+	return nil
+}
+
+// lock takes, changes or releases, if typ is lockUnlock, the lock of
+// owner on the range start to end of name. It returns lockBlocked if
+// another owner holds a conflicting lock.
+func (lt *lockTable) lock(name upspin.PathName, typ uint8, start, end uint64, owner lockOwner) uint8 {
+	if typ > lockUnlock || start >= end {
+		return lockError
+	}
+	lt.mu.Lock()
+	defer lt.mu.Unlock()
+	if typ != lockUnlock && lt.conflict(name, typ, start, end, owner) != nil {
+		return lockBlocked
+	}
+	// The new lock replaces those of owner in the range,
+	// which are trimmed or split.
+	var locks []lockRange
+	for _, l := range lt.locks[name] {
+		if l.owner != owner || !l.overlaps(start, end) {
+			locks = append(locks, l)
+			continue
+		}
+		if l.start < start {
+			before := l
+			before.end = start
+			locks = append(locks, before)
+		}
+		if l.end > end {
+			after := l
+			after.start = end
+			locks = append(locks, after)
+		}
+	}
+	if typ != lockUnlock {
+		locks = append(locks, lockRange{typ: typ, start: start, end: end, owner: owner})
+	}
+	if len(locks) == 0 {
+		delete(lt.locks, name)
+	} else {
+		lt.locks[name] = locks
+	}
+	return lockSuccess
+}
+
+// test returns a lock conflicting with a lock of owner of type typ
+// on the range start to end of name, or nil if it could be taken.
+func (lt *lockTable) test(name upspin.PathName, typ uint8, start, end uint64, owner lockOwner) *lockRange {
+	lt.mu.Lock()
+	defer lt.mu.Unlock()
+	if l := lt.conflict(name, typ, start, end, owner); l != nil {
+		conflict := *l
+		return &conflict
+	}
+	return nil
+}
+
+// release releases all the locks held through conn.
+func (lt *lockTable) release(conn *dotlConn) {
+	lt.mu.Lock()
+	defer lt.mu.Unlock()
+	for name, locks := range lt.locks {
+		var kept []lockRange
+		for _, l := range locks {
+			if l.owner.conn != conn {
+				kept = append(kept, l)
+			}
+		}
+		if len(kept) == 0 {
+			delete(lt.locks, name)
+		} else {
+			lt.locks[name] = kept
+		}
+	}
+}
+
+func (c *dotlConn) lock(d *ldec, r *lenc) error {
+	n, typ := d.u32(), d.u8()
+	d.u32() // flags; the client retries blocking locks itself
+	start, length := d.u64(), d.u64()
+	proc := d.u32()
+	client := d.str()
+	if d.err != nil {
+		return d.err
+	}
+	fid, err := c.fid(n)
+	if err != nil {
+		return err
+	}
+	if fid.isDir() {
+		return errIsDir
+	}
+	owner := lockOwner{conn: c, proc: proc, client: client}
+	r.u8(c.fs.locks.lock(fid.path, typ, start, lockEnd(start, length), owner))
+	return nil
+}
+
+func (c *dotlConn) getlock(d *ldec, r *lenc) error {
+	n, typ := d.u32(), d.u8()
+	start, length := d.u64(), d.u64()
+	proc := d.u32()
+	client := d.str()
+	if d.err != nil {
+		return d.err
+	}
+	fid, err := c.fid(n)
+	if err != nil {
+		return err
+	}
+	if fid.isDir() {
+		return errIsDir
+	}
+	owner := lockOwner{conn: c, proc: proc, client: client}
+	l := c.fs.locks.test(fid.path, typ, start, lockEnd(start, length), owner)
+	if l == nil {
+		// The lock could be taken.
+		r.u8(lockUnlock)
+		r.u64(start)
+		r.u64(length)
+		r.u32(proc)
+		r.str(client)
+		return nil
+	}
+	r.u8(l.typ)
+	r.u64(l.start)
+	if l.end == ^uint64(0) {
+		r.u64(0)
+	} else {
+		r.u64(l.end - l.start)
+	}
+	r.u32(l.owner.proc)
+	r.str(l.owner.client)
+	return nil
+}
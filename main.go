@@ -22,6 +22,10 @@ const cmdName = "9upspinfs"
 var _9pnet = flag.String("9pnet", "service", "network name for listen address")
 var _9paddr = flag.String("9paddr", "upspin", "network listen address")
 var debug = flag.Int("debug", 0, "9P debug level")
+var usersDir = flag.String("usersdir", "", "`directory` holding <user>/config for each user an attach may act as")
+var readOnly = flag.Bool("readonly", false, "serve the tree read-only, rejecting every change")
+var exportsFile = flag.String("exports", "", "`file` holding a table of the exports an attach may name")
+var allow = flag.String("allow", "", "comma-separated list of Upspin `users` allowed to attach; if set, clients must authenticate")
 
 func usage() {
 	fmt.Fprintf(os.Stderr, "Usage: %s\n", os.Args[0])
@@ -60,5 +64,28 @@ func main() {
 		usage()
 		os.Exit(2)
 	}
-	do(cfg, *_9pnet, *_9paddr, *debug)
+	allowed, err := parseAllow(*allow)
+	if err != nil {
+		log.Fatalf("%s: bad -allow list: %s", cmdName, err)
+	}
+	if *usersDir != "" && len(allowed) == 0 {
+		// Otherwise anyone could act as any user with a config.
+		log.Fatalf("%s: -usersdir requires -allow", cmdName)
+	}
+	var exports map[string]*export
+	if *exportsFile != "" {
+		exports, err = readExports(*exportsFile)
+		if err != nil {
+			log.Fatalf("%s: %s", cmdName, err)
+		}
+	}
+	do(cfg, *_9pnet, *_9paddr, &options{
+		debug:     *debug,
+		allow:     allowed,
+		usersDir:  *usersDir,
+		cacheDir:  flags.CacheDir,
+		cacheSize: flags.CacheSize,
+		readOnly:  *readOnly,
+		exports:   exports,
+	})
 }
@@ -0,0 +1,179 @@
+// Copyright 2018 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"sync"
+	"time"
+
+	"upspin.io/access"
+	"upspin.io/log"
+	"upspin.io/path"
+	"upspin.io/upspin"
+
+	go9p "github.com/lionkov/go9p/p"
+)
+
+// accessTTL is how long we trust a cached answer to WhichAccess.
+const accessTTL = time.Minute
+
+// anyone is a user name that no Access file mentions, used to
+// compute the rights granted to all users.
+const anyone = upspin.UserName("nobody@9upspinfs.invalid")
+
+// accessCache remembers which Access file governs a directory and
+// the parsed contents of the Access files seen.
+type accessCache struct {
+	mu     sync.Mutex
+	which  map[upspin.PathName]whichAccess
+	parsed map[upspin.PathName]parsedAccess
+}
+
+type whichAccess struct {
+	entry   *upspin.DirEntry // nil if no Access file applies
+	expires time.Time
+}
+
+type parsedAccess struct {
+	sequence int64
+	acc      *access.Access
+}
+
+// size returns the number of directories whose Access file is
+// remembered and the number of parsed Access files.
+func (ac *accessCache) size() (which, parsed int) {
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+	return len(ac.which), len(ac.parsed)
+}
+
+// flush forgets everything remembered.
+func (ac *accessCache) flush() {
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+	ac.which = make(map[upspin.PathName]whichAccess)
+	ac.parsed = make(map[upspin.PathName]parsedAccess)
+}
+
+// dir2Dir is like the function dir2Dir but sets the owner, group and
+// permission bits from the Access file governing d. The owner is the
+// owner of the tree holding d, the group is the user of id, and the
+// last modifier is d's writer. The owner, group and other bits hold
+// the rights of the owner, of id's user, and of all users. For files
+// r, w and x stand for the Read, Write and List rights; for directories
+// they stand for List, Create and any right at all, which is what
+// listing, creating files and walking need.
+func (id *identity) dir2Dir(name string, d *upspin.DirEntry) *go9p.Dir {
+	dir := dir2Dir(name, d)
+	me := string(id.cfg.UserName())
+	dir.Gid = me
+	if d == nil {
+		// The synthetic root.
+		dir.Uid = me
+		dir.Mode = go9p.DMDIR | 0555
+		return dir
+	}
+	p, err := path.Parse(d.Name)
+	if err != nil {
+		return dir
+	}
+	acc, err := id.access(d)
+	if err != nil {
+		log.Debug.Printf("9upspinfs: cannot determine access to %s: %v", d.Name, err)
+		return dir
+	}
+	dir.Uid = string(p.User())
+	dir.Muid = string(d.Writer)
+	dir.Mode &^= 0777
+	dir.Mode |= id.rights(acc, d, p.User())<<6 | id.rights(acc, d, id.cfg.UserName())<<3 | id.rights(acc, d, anyone)
+	return dir
+}
+
+// rights returns the permission bits of user u for entry d,
+// governed by acc, or by the default rules if acc is nil.
+func (id *identity) rights(acc *access.Access, d *upspin.DirEntry, u upspin.UserName) uint32 {
+	rights := [3]access.Right{access.Read, access.Write, access.List}
+	if d.IsDir() {
+		rights = [3]access.Right{access.List, access.Create, access.AnyRight}
+	}
+	var bits uint32
+	for i, r := range rights {
+		var ok bool
+		if acc == nil {
+			owner, _ := defaultUser(d.Name)
+			ok = u == owner
+		} else {
+			ok, _ = acc.Can(u, r, d.Name, id.client.Get)
+		}
+		if ok {
+			bits |= 4 >> uint(i)
+		}
+	}
+	return bits
+}
+
+// defaultUser returns the only user with rights to name when no
+// Access file governs it: the owner of the tree holding name.
+func defaultUser(name upspin.PathName) (upspin.UserName, error) {
+	p, err := path.Parse(name)
+	if err != nil {
+		return "", err
+	}
+	return p.User(), nil
+}
+
+// access returns the parsed Access file governing d,
+// or nil if there is none.
+func (id *identity) access(d *upspin.DirEntry) (*access.Access, error) {
+	dir := d.Name
+	if !d.IsDir() {
+		p, err := path.Parse(d.Name)
+		if err != nil {
+			return nil, err
+		}
+		dir = p.Drop(1).Path()
+	}
+
+	ac := &id.accessCache
+	ac.mu.Lock()
+	w, ok := ac.which[dir]
+	ac.mu.Unlock()
+	if !ok || time.Now().After(w.expires) {
+		ds, err := id.client.DirServer(dir)
+		if err != nil {
+			return nil, err
+		}
+		entry, err := ds.WhichAccess(dir)
+		if err != nil {
+			return nil, err
+		}
+		w = whichAccess{entry: entry, expires: time.Now().Add(accessTTL)}
+		ac.mu.Lock()
+		ac.which[dir] = w
+		ac.mu.Unlock()
+	}
+	if w.entry == nil {
+		return nil, nil
+	}
+
+	ac.mu.Lock()
+	pa, ok := ac.parsed[w.entry.Name]
+	ac.mu.Unlock()
+	if ok && pa.sequence == w.entry.Sequence {
+		return pa.acc, nil
+	}
+	data, err := id.client.Get(w.entry.Name)
+	if err != nil {
+		return nil, err
+	}
+	acc, err := access.Parse(w.entry.Name, data)
+	if err != nil {
+		return nil, err
+	}
+	ac.mu.Lock()
+	ac.parsed[w.entry.Name] = parsedAccess{sequence: w.entry.Sequence, acc: acc}
+	ac.mu.Unlock()
+	return acc, nil
+}
@@ -0,0 +1,157 @@
+// Copyright 2018 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// This file implements the share control command, which does what is
+// otherwise done by editing an Access file and running upspin share.
+// The work is done as the user of the server's config, with its keys.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"upspin.io/access"
+	"upspin.io/errors"
+	"upspin.io/pack"
+	"upspin.io/path"
+	"upspin.io/upspin"
+)
+
+// ctlShare executes the share command, one of
+//
+//	share add rights users path
+//	share fix path
+func (f *upspinFS) ctlShare(args []string) error {
+	switch {
+	case len(args) == 4 && args[0] == "add":
+		return f.shareAdd(args[1], args[2], upspin.PathName(args[3]))
+	case len(args) == 2 && args[0] == "fix":
+		return f.shareFix(upspin.PathName(args[1]))
+	}
+	return errBadCtl
+}
+
+// shareAdd grants rights, a list such as r,l, to users, a list of users
+// and groups, by adding a line to the Access file governing name. If no
+// Access file governs name, one is created in its directory, keeping the
+// rights of the owner. The line is not added again if the Access file
+// already holds it. The keys of the files in the directory of the Access
+// file, all of which it may govern, are then rewrapped for their readers.
+func (f *upspinFS) shareAdd(rights, users string, name upspin.PathName) error {
+	const op errors.Op = "9upspinfs.share"
+	id := f.owner
+	entry, err := id.client.Lookup(name, true)
+	if err != nil {
+		return errors.E(op, err)
+	}
+	dir := entry.Name
+	if !entry.IsDir() {
+		dir = path.DropPath(dir, 1)
+	}
+	if err := f.checkWritableName(dir); err != nil {
+		return err
+	}
+	ds, err := id.client.DirServer(dir)
+	if err != nil {
+		return errors.E(op, err)
+	}
+	accEntry, err := ds.WhichAccess(dir)
+	if err != nil {
+		return errors.E(op, err)
+	}
+	var accName upspin.PathName
+	var data []byte
+	if accEntry == nil {
+		p, err := path.Parse(dir)
+		if err != nil {
+			return errors.E(op, err)
+		}
+		accName = path.Join(dir, access.AccessFile)
+		data = []byte(fmt.Sprintf("*: %s\n", p.User()))
+	} else {
+		accName = accEntry.Name
+		if data, err = id.client.Get(accName); err != nil {
+			return errors.E(op, err)
+		}
+		if len(data) > 0 && data[len(data)-1] != '\n' {
+			data = append(data, '\n')
+		}
+	}
+	line := fmt.Sprintf("%s: %s", rights, users)
+	for _, l := range strings.Split(string(data), "\n") {
+		if strings.TrimSpace(l) == line {
+			return f.shareFix(path.DropPath(accName, 1))
+		}
+	}
+	data = append(data, line+"\n"...)
+	if _, err := access.Parse(accName, data); err != nil {
+		return errors.E(op, accName, errors.Invalid, err)
+	}
+	if _, err := id.client.Put(accName, data); err != nil {
+		return errors.E(op, err)
+	}
+	id.accessCache.flush()
+	return f.shareFix(path.DropPath(accName, 1))
+}
+
+// shareFix rewraps the keys of the file name, or of every file within
+// the directory name, so that exactly the users who may read each file
+// can decrypt it.
+func (f *upspinFS) shareFix(name upspin.PathName) error {
+	const op errors.Op = "9upspinfs.share"
+	if err := f.checkWritableName(name); err != nil {
+		return err
+	}
+	id := f.owner
+	entry, err := id.client.Lookup(name, false)
+	if err != nil {
+		return errors.E(op, err)
+	}
+	switch {
+	case entry.IsLink():
+		return nil
+	case entry.IsDir():
+		entries, err := id.client.Glob(string(entry.Name) + "/*")
+		if err != nil {
+			return errors.E(op, err)
+		}
+		for _, e := range entries {
+			if err := f.shareFix(e.Name); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return rewrap(id, entry)
+}
+
+// rewrap wraps the key of the file entry for the users who may read it.
+// Only files packed with EEPack have keys wrapped for their readers.
+func rewrap(id *identity, entry *upspin.DirEntry) error {
+	const op errors.Op = "9upspinfs.share"
+	if entry.Packing != upspin.EEPack {
+		return nil
+	}
+	keys, err := readerKeys(id.cfg, id.client, entry.Name)
+	if err != nil {
+		return errors.E(op, err)
+	}
+	// A copy, so that an entry the caches hold is not changed.
+	e := *entry
+	packdata := []*[]byte{&e.Packdata}
+	pack.Lookup(e.Packing).Share(id.cfg, keys, packdata)
+	if packdata[0] == nil {
+		return errors.E(op, e.Name, errors.Permission, "cannot rewrap key")
+	}
+	e.Packdata = *packdata[0]
+	ds, err := id.client.DirServer(e.Name)
+	if err != nil {
+		return errors.E(op, err)
+	}
+	if _, err := ds.Put(&e); err != nil {
+		return errors.E(op, err)
+	}
+	return nil
+}
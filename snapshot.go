@@ -0,0 +1,122 @@
+// Copyright 2018 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"upspin.io/errors"
+	"upspin.io/path"
+	"upspin.io/upspin"
+	"upspin.io/user"
+
+	go9p "github.com/lionkov/go9p/p"
+	"github.com/lionkov/go9p/p/srv"
+)
+
+// snapshotDir is the directory in the root of each user's tree through
+// which the snapshots of the tree, kept by the directory server in the
+// tree of the user's snapshot user, user+snapshot@domain, are reached.
+const snapshotDir = ".snapshot"
+
+var errReadOnly = &go9p.Error{Err: "snapshots are read-only", Errornum: eROFS}
+
+// snapshotRoot returns the root of the snapshot tree of the user whose
+// root is dir, or the empty string if dir is not the root of a tree
+// that has snapshots. Only the trees of users without a suffix do:
+// those of ann+work@example.com are not in ann+snapshot@example.com.
+func snapshotRoot(dir upspin.PathName) upspin.PathName {
+	p, err := path.Parse(dir)
+	if err != nil || !p.IsRoot() {
+		return ""
+	}
+	name, suffix, domain, err := user.Parse(p.User())
+	if err != nil || suffix != "" {
+		return ""
+	}
+	return upspin.PathName(name + "+" + upspin.SnapshotSuffix + "@" + domain)
+}
+
+// snapshotParent returns the root of the tree whose snapshots are kept
+// in the snapshot tree whose root is dir, which is where walking ".."
+// from snapshotDir leads, or the empty string if dir is not the root of
+// a snapshot tree.
+func snapshotParent(dir upspin.PathName) upspin.PathName {
+	p, err := path.Parse(dir)
+	if err != nil || !p.IsRoot() {
+		return ""
+	}
+	name, suffix, domain, err := user.Parse(p.User())
+	if err != nil || suffix != upspin.SnapshotSuffix {
+		return ""
+	}
+	return upspin.PathName(name + "@" + domain)
+}
+
+// isSnapshot reports whether name is within a snapshot tree.
+func isSnapshot(name upspin.PathName) bool {
+	p, err := path.Parse(name)
+	if err != nil {
+		return false
+	}
+	_, suffix, _, err := user.Parse(p.User())
+	return err == nil && suffix == upspin.SnapshotSuffix
+}
+
+// checkWritable returns an error if name may not be changed through fid.
+func (f *upspinFS) checkWritable(fid *Fid, name upspin.PathName) error {
+	if fid.info || fid.effective {
+		return srv.Eperm
+	}
+	if e := fid.export; e != nil {
+		if e.readOnly {
+			return errReadOnlyServer
+		}
+		if !within(name, e.root) {
+			return srv.Eperm
+		}
+	}
+	return f.checkWritableName(name)
+}
+
+// checkWritableName returns an error if name may not be changed at all.
+func (f *upspinFS) checkWritableName(name upspin.PathName) error {
+	if f.readOnly {
+		return errReadOnlyServer
+	}
+	if isSnapshot(name) {
+		return errReadOnly
+	}
+	return nil
+}
+
+// snapshotDirEntry returns the entry listed as snapshotDir in the root
+// dir of a user's tree, or nil if there is none.
+func (f *upspinFS) snapshotDirEntry(id *identity, dir upspin.PathName) *go9p.Dir {
+	root := snapshotRoot(dir)
+	if root == "" {
+		return nil
+	}
+	entry, err := id.client.Lookup(root, false)
+	if err != nil {
+		return nil
+	}
+	d := f.dir2Dir(id, string(root), entry)
+	d.Name = snapshotDir
+	return d
+}
+
+// ctlSnapshot asks the directory server to take a snapshot
+// of the tree of the server's user.
+func (f *upspinFS) ctlSnapshot(args []string) error {
+	const op errors.Op = "9upspinfs.snapshot"
+	root := snapshotRoot(upspin.PathName(f.cfg.UserName()))
+	if root == "" {
+		return errors.E(op, f.cfg.UserName(), errors.Invalid, "only users without a suffix have snapshots")
+	}
+	if f.readOnly {
+		return errReadOnlyServer
+	}
+	_, err := f.owner.client.Put(root+"/"+upspin.SnapshotControlFile, nil)
+	return err
+}
@@ -0,0 +1,126 @@
+// Copyright 2018 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// This file implements the extended attributes of 9P2000.L, through
+// which the metadata of a directory entry that does not fit in a stat is
+// read. The attributes are in the user.upspin namespace and cannot be set.
+
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+
+	"upspin.io/upspin"
+
+	go9p "github.com/lionkov/go9p/p"
+)
+
+const xattrPrefix = "user.upspin."
+
+var errNoAttr = &go9p.Error{Err: "no such attribute", Errornum: eNODATA}
+
+// xattr is an extended attribute.
+type xattr struct {
+	name  string
+	value string
+}
+
+// xattrs returns the extended attributes of the entry d.
+func xattrs(d *upspin.DirEntry) []xattr {
+	attrs := []xattr{
+		{"packing", d.Packing.String()},
+		{"sequence", strconv.FormatInt(d.Sequence, 10)},
+		{"signedname", string(d.SignedName)},
+		{"writer", string(d.Writer)},
+	}
+	if d.IsLink() {
+		attrs = append(attrs, xattr{"link", string(d.Link)})
+	}
+	if !d.IsDir() && !d.IsLink() {
+		// Each block is described by a line holding its offset,
+		// size, store endpoint and reference.
+		var refs bytes.Buffer
+		for _, b := range d.Blocks {
+			fmt.Fprintf(&refs, "%d %d %s %s\n", b.Offset, b.Size, b.Location.Endpoint, b.Location.Reference)
+		}
+		attrs = append(attrs,
+			xattr{"blocks", strconv.Itoa(len(d.Blocks))},
+			xattr{"refs", refs.String()},
+			xattr{"packdata", hex.EncodeToString(d.Packdata)},
+		)
+	}
+	for i := range attrs {
+		attrs[i].name = xattrPrefix + attrs[i].name
+	}
+	return attrs
+}
+
+// xattr returns the value of the extended attribute name of the file
+// fid refers to or, if name is empty, the list of the attribute names,
+// each terminated by a NUL byte.
+func (f *upspinFS) xattr(fid *Fid, name string) ([]byte, error) {
+	var attrs []xattr
+	if !fid.synthetic() {
+		entry, err := fid.id.client.Lookup(fid.path, false)
+		if err != nil {
+			return nil, err
+		}
+		attrs = xattrs(entry)
+	}
+	if name == "" {
+		list := []byte{}
+		for _, a := range attrs {
+			list = append(list, a.name...)
+			list = append(list, 0)
+		}
+		return list, nil
+	}
+	for _, a := range attrs {
+		if a.name == name {
+			return []byte(a.value), nil
+		}
+	}
+	return nil, errNoAttr
+}
+
+// xattrwalk makes newfid refer to the value of an extended attribute,
+// or to the list of attribute names, which is then read with Tread.
+func (c *dotlConn) xattrwalk(d *ldec, r *lenc) error {
+	n, newn := d.u32(), d.u32()
+	name := d.str()
+	if d.err != nil {
+		return d.err
+	}
+	fid, err := c.fid(n)
+	if err != nil {
+		return err
+	}
+	value, err := c.fs.xattr(fid.Fid, name)
+	if err != nil {
+		return err
+	}
+	if err := c.newFid(newn, &dotlFid{Fid: fid.clone(), xattr: value}); err != nil {
+		return err
+	}
+	r.u64(uint64(len(value)))
+	return nil
+}
+
+// xattrcreate is refused, since the attributes are those of Upspin.
+func (c *dotlConn) xattrcreate(d *ldec, r *lenc) error {
+	n := d.u32()
+	d.str() // name
+	d.u64() // attr_size
+	d.u32() // flags
+	if d.err != nil {
+		return d.err
+	}
+	if _, err := c.fid(n); err != nil {
+		return err
+	}
+	return errNotSup
+}